@@ -1,19 +1,24 @@
 package main
 
 import (
+	"context"
 	"data_api/client"
 	"data_api/server/config"
 	"data_api/server/controller"
 	"data_api/server/model"
 	routes "data_api/server/view"
 	"fmt"
+	"log"
 	_ "net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
+	_ "time/tzdata" // The time zones, for the machines without /usr/share/zoneinfo
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/lib/pq"
 )
 
 const bucket string = config.BUCKET
@@ -33,16 +38,49 @@ const url string = config.INFLUX_URL
 func main() {
 
 	var wg sync.WaitGroup
-	//Local :
-	db := controller.ConnectDB(config.POSTGRES_USERNAME, config.LOCAL_POSTGRES_PASSWORD,
-		config.POSTGRES_HOST, config.POSTGRES_PORT, config.POSTGRES_DB_NAME)
-
-	//Grid5000 :
-	//db := controller.ConnectDB(config.POSTGRES_USERNAME, config.REMOTE_POSTGRES_PASSWORD,	config.POSTGRES_HOST, config.POSTGRES_PORT, config.POSTGRES_DB_NAME)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM) //Cancelled by ctrl+C
+	defer stop()
+
+	var db model.SessionStore
+	var err error
+	if config.SESSION_BACKEND == "sqlite" {
+		db, err = controller.OpenSQLite(config.SQLITE_PATH)
+	} else {
+		//Local :
+		db, err = controller.ConnectDB(config.POSTGRES_USERNAME, config.LOCAL_POSTGRES_PASSWORD,
+			config.POSTGRES_HOST, config.POSTGRES_PORT, config.POSTGRES_DB_NAME)
+
+		//Grid5000 :
+		//db, err = controller.ConnectDB(config.POSTGRES_USERNAME, config.REMOTE_POSTGRES_PASSWORD,	config.POSTGRES_HOST, config.POSTGRES_PORT, config.POSTGRES_DB_NAME)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 	defer db.Close()
 
-	//controller.Reset(db) Reset the postgres db (delete all the tables)
-	controller.StartServer(db) //Create the tables if needed, and close any previous sessions that didn't end correctly
+	if len(os.Args) > 1 && os.Args[1] == "migrate" { //./main migrate [up | down [n] | status] manages the session db schema and exits
+		controller.MigrateCommand(db, os.Args[2:])
+		return
+	}
+
+	var energy model.EnergyStore //Shared by all the goroutines, closed only when the server stops
+	if config.ENERGY_BACKEND == "prometheus" {
+		energy = model.NewPrometheus(config.PROMETHEUS_WRITE_URL, config.PROMETHEUS_QUERY_URL)
+	} else {
+		tiers := model.DefaultTiers(config.RAW_RETENTION_DAYS, config.MINUTE_RETENTION_DAYS, config.HOUR_RETENTION_DAYS, config.DAY_RETENTION_DAYS)
+		influx := model.NewInflux(url, token, org, bucket, tiers...)
+		if err := influx.EnsureTierBuckets(ctx); err != nil {
+			fmt.Println("Couldn't create the rollup buckets :", err)
+		}
+		go influx.RunRollups(ctx, time.Minute) //Keep the 1m, 1h and 1d rollups up to date
+		energy = influx
+	}
+	defer energy.Close()
+
+	//controller.Reset(db, "admin") Reset the postgres db (delete all the tables)
+	if err := controller.StartServer(db); err != nil { //Create the tables if needed, and close any previous sessions that didn't end correctly
+		log.Fatal(err)
+	}
 
 	day := time.Now().Day() //To get today's DEMETER csv
 
@@ -54,15 +92,26 @@ func main() {
 	//go controller.MonitorEnergy(pointsChan, &wg)
 	wg.Add(1)
 
-	go model.PopulateDBFromChan(bucket, org, token, url, pointsChan, &wg) //Inserts the points from the channel into the influxdb
+	go energy.PopulateDBFromChan(pointsChan, &wg) //Inserts the points from the channel into the energy database
 	wg.Add(1)
 
+	go controller.RunSessionEnergy(ctx, db, energy, time.Minute)                       //Computes the energy of the sessions once they are closed
+	go controller.RunHeartbeat(ctx, db, config.HEARTBEAT_INTERVAL_SECONDS*time.Second) //Lets the next start know when this one stopped
+	if config.DETECT_SESSIONS {
+		go controller.RunSessionDetector(ctx, db, config.UTMP_PATH, config.SYSTEMD_SESSIONS_PATH, 5*time.Second) //Connects the users when they log into this machine
+	}
+	if config.IDLE_TIMEOUT_SECONDS > 0 {
+		go controller.RunIdleReaper(ctx, db, config.IDLE_TIMEOUT_SECONDS*time.Second, time.Minute) //Disconnects the users whose client stopped sending heartbeats
+	}
+
 	router := gin.Default() //Simulate a local server
-	routes.CreateRoutes(router, db, bucket, org, token, url)
+	routes.CreateRoutes(router, db, energy)
 	go router.Run("0.0.0.0:8080") //To accept connections from other IP addresses.
 
 	for i := range 10 {
-		controller.UserConnection(db, i) //Simulate 10 new users that connect to the server
+		if err := controller.UserConnection(db, i, model.SessionInfo{ClientType: "simulated"}, "simulation"); err != nil { //Simulate 10 new users that connect to the server
+			fmt.Println(err)
+		}
 	}
 
 	fmt.Println("Starting Fibo")
@@ -74,10 +123,14 @@ func main() {
 	time.Sleep(15 * time.Second)
 
 	for i := range 10 {
-		controller.UserDeconnection(db, i) //Disconnect the users
+		if err := controller.UserDeconnection(db, i, "simulation"); err != nil { //Disconnect the users
+			fmt.Println(err)
+		}
 	}
 
-	wg.Add(1) //To keep the server running even if no data is added to the csv
-	wg.Wait()
+	//Keep the server running (even if no data is added to the csv) until ctrl+C,
+	//so that the deferred calls close the databases correctly
+	<-ctx.Done()
+	fmt.Println("Shutting down the server...")
 
 }
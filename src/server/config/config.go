@@ -2,6 +2,9 @@ package config
 
 const (
 
+	//Database storing the energy points : "influx" or "prometheus"
+	ENERGY_BACKEND = "influx"
+
 	//Local influxdb data
 	BUCKET      = ""
 	INFLUX_URL  = "http://localhost:8086"
@@ -12,6 +15,14 @@ const (
 	REMOTE_ORG   = ""
 	REMOTE_TOKEN = ""
 
+	//Prometheus compatible database (prometheus started with --web.enable-remote-write-receiver, VictoriaMetrics...)
+	PROMETHEUS_WRITE_URL = "http://localhost:9090/api/v1/write"
+	PROMETHEUS_QUERY_URL = "http://localhost:9090"
+
+	//Database storing the users and their sessions : "postgres" or "sqlite" (a single file, handy for a single server)
+	SESSION_BACKEND = "postgres"
+	SQLITE_PATH     = "sessions.db"
+
 	//Local postgres data
 	POSTGRES_USERNAME       = "postgres"
 	LOCAL_POSTGRES_PASSWORD = ""
@@ -21,4 +32,43 @@ const (
 
 	//Remote postgres data (same username, host, port and db name)
 	REMOTE_POSTGRES_PASSWORD = "password"
+
+	//Retention in days of the raw energy points (in BUCKET) and of their 1 minute, 1 hour and 1 day rollups
+	//(in BUCKET_1m, BUCKET_1h and BUCKET_1d). 0 keeps the points forever, except for BUCKET : 0 leaves its retention
+	//as it is, since setting one deletes the older history (the older days are then read from the rollups)
+	RAW_RETENTION_DAYS    = 0
+	MINUTE_RETENTION_DAYS = 90
+	HOUR_RETENTION_DAYS   = 730
+	DAY_RETENTION_DAYS    = 0
+
+	//Name of this server in the "host" tag of the energy points. Leave empty to use the hostname of the machine
+	HOST_NAME = ""
+
+	//Token expected in the "Authorization: Bearer ..." header of the /admin endpoints. They are disabled while it is empty
+	ADMIN_TOKEN = ""
+
+	//Token expected in the "Authorization: Bearer ..." header of the write endpoints (POST /sessions, DELETE /sessions/:id, POST /users, the heartbeats...).
+	//They are disabled while it is empty
+	API_TOKEN = ""
+
+	//Seconds between two heartbeats. After a crash, the sessions left open are closed at the last heartbeat
+	HEARTBEAT_INTERVAL_SECONDS = 30
+
+	//Seconds without heartbeat (POST .../users/:id/heartbeat) after which a user is disconnected at their last one. 0 disables it.
+	//The clients that never send heartbeats are never disconnected this way
+	IDLE_TIMEOUT_SECONDS = 900
+
+	//How the consumption of a time-range is shared between the users connected : "sessions" (in proportion to their open sessions)
+	//or "users" (equally, however many sessions each one has)
+	ATTRIBUTION = "sessions"
+
+	//Time zone (IANA name) the days, weeks, months and years start in, for the users without one of their own.
+	//A request can give another one with ?tz=Europe/Paris
+	DEFAULT_TIMEZONE = "UTC"
+
+	//Open and close the sessions automatically from the login records of the machine, the users being known by their unix username.
+	//Leave a path empty to not read it
+	DETECT_SESSIONS       = false
+	UTMP_PATH             = "/var/run/utmp"
+	SYSTEMD_SESSIONS_PATH = "/run/systemd/sessions"
 )
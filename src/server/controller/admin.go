@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"data_api/server/config"
+	"data_api/server/model"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Gin middleware protecting the /admin endpoints : the request must carry the header
+// "Authorization: Bearer <config.ADMIN_TOKEN>". While ADMIN_TOKEN is empty, every request is refused.
+// The changes they make are recorded in the audit log as done by "admin".
+func AdminAuth() gin.HandlerFunc {
+	return tokenAuth(config.ADMIN_TOKEN, "admin", "admin token required")
+}
+
+// Gin middleware protecting the write endpoints (POST /sessions...) : the request must carry the header
+// "Authorization: Bearer <config.API_TOKEN>". While API_TOKEN is empty, every request is refused.
+// The changes they make are recorded in the audit log as done by "api".
+func APIAuth() gin.HandlerFunc {
+	return tokenAuth(config.API_TOKEN, "api", "api token required")
+}
+
+// Key of the gin context holding the actor of an authenticated request, see requestActor.
+const actorKey = "actor"
+
+// Refuse with 401 the requests without the header "Authorization: Bearer <expected>", or all of them if expected is empty.
+// The requests accepted are done by actor, the owner of the token.
+func tokenAuth(expected, actor, message string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if expected == "" || !ok || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": message})
+			return
+		}
+		c.Set(actorKey, actor)
+		c.Next()
+	}
+}
+
+// Return who the request was authenticated as by AdminAuth or APIAuth, kept in the audit log. The client can't choose it.
+func requestActor(c *gin.Context) string {
+	return c.GetString(actorKey)
+}
+
+// Body of the erasure requests.
+type erasureRequest struct {
+	Mode   string `json:"mode"`   // "delete", "pseudonymise" or "export"
+	Reason string `json:"reason"` // Why (reference of the request of the user...), kept in the audit log
+}
+
+// Erase the user with this id, see model.EraseUser for the modes.
+func EraseUser(store model.SessionStore, id int, mode, actor, reason string) (model.ErasureReport, error) {
+	return store.EraseUser(id, mode, actor, reason)
+}
+
+// Gin handler function for the admin endpoint. Erase the user specified by the id in the url, with the mode
+// and reason given in the json body, and answer with what was done (and everything about the user in export mode).
+// Access it with POST .../admin/users/:id/erase {"mode": "pseudonymise", "reason": "request #12"}
+func EraseUserHandler(store model.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		var req erasureRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abortWithError(c, fmt.Errorf("%w: %v", model.ErrInvalidInput, err))
+			return
+		}
+		report, err := EraseUser(store, id, req.Mode, requestActor(c), req.Reason)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, report)
+	}
+}
+
+// Return the time of the query parameter name (RFC 3339, like 2024-05-01T00:00:00Z), the zero time if it is absent.
+func queryTime(c *gin.Context, name string) (time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("%w: bad %s %q, expected a RFC 3339 time", model.ErrInvalidInput, name, value)
+	}
+	return t, nil
+}
+
+// Gin handler function for the admin endpoint. Retrieve the entries of the audit log, the most recent first :
+// who did what, on which user, when, and the values it changed. All the parameters are optional :
+// user (id of the user), from and to (RFC 3339 times) and limit (1000 by default).
+// Access it with .../admin/audit?user=12&from=2024-05-01T00:00:00Z&to=2024-06-01T00:00:00Z
+func GetAuditLog(store model.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.Atoi(c.DefaultQuery("user", "0"))
+		if err != nil || userID < 0 {
+			abortWithError(c, fmt.Errorf("%w: bad user id %q", model.ErrInvalidInput, c.Query("user")))
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "1000"))
+		if err != nil || limit < 1 {
+			abortWithError(c, fmt.Errorf("%w: bad limit %q", model.ErrInvalidInput, c.Query("limit")))
+			return
+		}
+		from, err := queryTime(c, "from")
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		to, err := queryTime(c, "to")
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		entries, err := store.GetAuditLog(userID, from, to, limit)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, entries)
+	}
+}
+
+// Gin handler function for the admin endpoint. Derive all the time-ranges and links again from the session events,
+// after a change of the way they are derived for instance. The closed sessions get their energy computed again.
+// Access it with POST .../admin/plages/rebuild
+func RebuildTimeRanges(store model.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := store.RebuildTimeRanges(requestActor(c)); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,372 @@
+package controller
+
+import (
+	"cmp"
+	"data_api/server/config"
+	"data_api/server/model"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// What the consumption endpoints of the api v2 can be about.
+const (
+	SubjectUser  = "user"
+	SubjectGroup = "group"
+)
+
+// Shared by all the answers of the api v2 : how to read their values.
+type v2Meta struct {
+	Version     string    `json:"version"`
+	Unit        string    `json:"unit"`        // J or mWh, the unit of every energy value of the answer (empty if no point was read)
+	Timezone    string    `json:"timezone"`    // The one the days, weeks, months and years start in
+	Attribution string    `json:"attribution"` // How the consumption of a time-range is shared between the users, see ATTRIBUTION
+	Host        string    `json:"host"`        // The server whose points are read, empty for all of them
+	GeneratedAt time.Time `json:"generatedAt"`
+}
+
+// The user or group an answer is about.
+type v2Subject struct {
+	Kind string `json:"kind"`
+	ID   int    `json:"id"`
+}
+
+// A period of time, from start included to stop excluded.
+type v2Period struct {
+	Start time.Time `json:"start"`
+	Stop  time.Time `json:"stop"`
+}
+
+// An energy point of an answer.
+type v2Point struct {
+	At    time.Time `json:"at"`
+	Value float64   `json:"value"`
+}
+
+// The mean consumption of a period. The means are per raw point of the energy database (every 10s or so),
+// so they don't depend on how long the user was connected.
+type v2Mean struct {
+	v2Period
+	Mean float64 `json:"mean"`
+}
+
+// The rank of the subject over a period, 1 being the one that consumed the least.
+type v2Rank struct {
+	v2Period
+	Name string `json:"name"` // year, month, week or day
+	Rank int    `json:"rank"`
+}
+
+// A window of an energy series.
+type v2Window struct {
+	v2Period
+	Value float64 `json:"value"`
+	Count int     `json:"count"` // The number of raw points in the window
+}
+
+// Answer of .../today.
+type v2DayResponse struct {
+	Meta    v2Meta    `json:"meta"`
+	Subject v2Subject `json:"subject"`
+	Period  v2Period  `json:"period"`
+	Max     v2Point   `json:"max"`
+	Min     v2Point   `json:"min"`
+	Sum     float64   `json:"sum"`
+	Mean    float64   `json:"mean"`
+}
+
+// Answer of .../consumption and .../weeklyMean.
+type v2MeansResponse struct {
+	Meta    v2Meta    `json:"meta"`
+	Subject v2Subject `json:"subject"`
+	Means   []v2Mean  `json:"means"`
+}
+
+// Answer of .../rank.
+type v2RankResponse struct {
+	Meta    v2Meta    `json:"meta"`
+	Subject v2Subject `json:"subject"`
+	Ranks   []v2Rank  `json:"ranks"`
+	Total   int       `json:"total"` // The number of users, or of groups of the same kind, ranked
+}
+
+// Answer of .../energy.
+type v2SeriesResponse struct {
+	Meta      v2Meta     `json:"meta"`
+	Subject   v2Subject  `json:"subject"`
+	Period    v2Period   `json:"period"`
+	Step      string     `json:"step"`
+	Aggregate string     `json:"aggregate"`
+	Windows   []v2Window `json:"windows"`
+}
+
+// An EnergyStore recording the units of the points it returns, so that an answer can state the unit of its values.
+type unitRecorder struct {
+	model.EnergyStore
+	mu    sync.Mutex
+	units map[string]bool
+}
+
+func (u *unitRecorder) GetData(start, stop time.Time, resolution time.Duration, filter model.Tags) ([]model.Point, error) {
+	points, err := u.EnergyStore.GetData(start, stop, resolution, filter)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, p := range points {
+		u.units[p.Tags.Unit] = true
+	}
+	return points, err
+}
+
+// Return the unit of all the points returned so far, empty if there were none.
+// If they are in several units, their values can't be added : the error wraps model.ErrInvalidInput.
+func (u *unitRecorder) unit() (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	units := slices.Sorted(maps.Keys(u.units))
+	if len(units) > 1 {
+		return "", fmt.Errorf("%w: the points are in several units %q, choose one with ?unit=", model.ErrInvalidInput, units)
+	}
+	if len(units) == 1 {
+		return units[0], nil
+	}
+	return "", nil
+}
+
+// A request to a consumption endpoint of the api v2, read by readV2Request.
+type v2Request struct {
+	subject    v2Subject
+	timeRanges []model.TimeRange
+	cal        Calendar
+	filter     model.Tags
+	energy     *unitRecorder // The energy store the answer must be computed from
+	meta       v2Meta
+}
+
+// Read the subject of the url (a user or a group, depending on kind) with its time-ranges, the calendar (see calendarFromQuery)
+// and the tags of the points. The points are only filtered on their unit if ?unit= is given : the unit stated by
+// the meta of the answer is the one of the points read (see finalMeta).
+func readV2Request(c *gin.Context, store model.SessionStore, energy model.EnergyStore, kind string) (v2Request, error) {
+	req := v2Request{energy: &unitRecorder{EnergyStore: energy, units: map[string]bool{}}}
+	id, err := paramID(c)
+	if err != nil {
+		return req, err
+	}
+	req.subject = v2Subject{Kind: kind, ID: id}
+
+	timezone := c.Query("tz")
+	if kind == SubjectUser {
+		user, err := store.GetUserById(id)
+		if err != nil {
+			return req, err
+		}
+		timezone = cmp.Or(timezone, user.Timezone)
+		req.timeRanges, err = getUserTimes(id, store)
+		if err != nil {
+			return req, err
+		}
+	} else {
+		req.timeRanges, err = store.GetGroupTimes(id)
+		if err != nil {
+			return req, err
+		}
+	}
+	if req.cal, err = NewCalendar(timezone); err != nil {
+		return req, err
+	}
+
+	req.filter = tagsFromQuery(c)
+	if _, ok := model.ToJoules(0, req.filter.Unit); req.filter.Unit != "" && !ok {
+		return req, fmt.Errorf("%w: unknown unit %q, expected J or mWh", model.ErrInvalidInput, req.filter.Unit)
+	}
+
+	req.meta = v2Meta{Version: "2", Unit: req.filter.Unit, Timezone: req.cal.Name(), Attribution: config.ATTRIBUTION,
+		Host: req.filter.Host, GeneratedAt: time.Now().UTC()}
+	return req, nil
+}
+
+// Return the meta of the answer, once it is computed from req.energy : its unit is the one of the points read.
+func (req v2Request) finalMeta() (v2Meta, error) {
+	unit, err := req.energy.unit()
+	if err != nil {
+		return req.meta, err
+	}
+	meta := req.meta
+	meta.Unit = cmp.Or(unit, meta.Unit)
+	return meta, nil
+}
+
+// Gin handler function for the api v2 endpoint. Same as GetTodayHighlights (or GetGroupTodayHighlights), with the day
+// and its highlights named.
+// Access it with .../api/v2/users/:id/today?date=2024-05-01&tz=Europe/Paris&unit=J or .../api/v2/groups/:id/today
+func GetTodayV2(store model.SessionStore, energy model.EnergyStore, kind string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req, err := readV2Request(c, store, energy, kind)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		day, err := queryDate(c, req.cal)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		highlights, err := getDayHighlights(req.cal, day, req.timeRanges, req.energy, req.filter)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		start, stop := req.cal.Day(day)
+		meta, err := req.finalMeta()
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, v2DayResponse{
+			Meta:    meta,
+			Subject: req.subject,
+			Period:  v2Period{Start: start, Stop: stop},
+			Max:     v2Point{At: highlights.Max.Timestamp, Value: highlights.Max.Value},
+			Min:     v2Point{At: highlights.Min.Timestamp, Value: highlights.Min.Value},
+			Sum:     highlights.Sum,
+			Mean:    highlights.Mean,
+		})
+	}
+}
+
+// Gin handler function for the api v2 endpoint. Same as GetAllDailyMean (or GetGroupAllDailyMean), each mean with its day.
+// Access it with .../api/v2/users/:id/consumption or .../api/v2/groups/:id/consumption
+func GetDailyMeansV2(store model.SessionStore, energy model.EnergyStore, kind string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req, err := readV2Request(c, store, energy, kind)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		dailyMeans, err := getAllDailyMean(req.cal, req.timeRanges, req.energy, req.filter)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		means := []v2Mean{}
+		for _, p := range dailyMeans {
+			start, stop := req.cal.Day(p.Timestamp)
+			means = append(means, v2Mean{v2Period: v2Period{Start: start, Stop: stop}, Mean: p.Value})
+		}
+		meta, err := req.finalMeta()
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, v2MeansResponse{Meta: meta, Subject: req.subject, Means: means})
+	}
+}
+
+// Gin handler function for the api v2 endpoint. Same as GetWeeklyMean (or GetGroupWeeklyMean), each mean with its week,
+// the ongoing week first.
+// Access it with .../api/v2/users/:id/weeklyMean or .../api/v2/groups/:id/weeklyMean
+func GetWeeklyMeansV2(store model.SessionStore, energy model.EnergyStore, kind string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req, err := readV2Request(c, store, energy, kind)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		weeklyMeans, err := getAllWeeklyMeans(req.cal, req.timeRanges, req.energy, req.filter)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		means := []v2Mean{}
+		start, stop := req.cal.Week(time.Now())
+		for _, mean := range weeklyMeans {
+			means = append(means, v2Mean{v2Period: v2Period{Start: start, Stop: stop}, Mean: mean})
+			start, stop = start.AddDate(0, 0, -7), start
+		}
+		meta, err := req.finalMeta()
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, v2MeansResponse{Meta: meta, Subject: req.subject, Means: means})
+	}
+}
+
+// Gin handler function for the api v2 endpoint. Same as GetRank (or GetGroupRank), each rank with its period.
+// Access it with .../api/v2/users/:id/rank or .../api/v2/groups/:id/rank
+func GetRankV2(store model.SessionStore, energy model.EnergyStore, kind string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req, err := readV2Request(c, store, energy, kind)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		var ranks []int
+		if kind == SubjectUser {
+			ranks, err = RankUser(req.subject.ID, store, req.energy, req.filter, req.cal)
+		} else {
+			ranks, err = RankGroup(req.subject.ID, store, req.energy, req.filter, req.cal)
+		}
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		now := time.Now()
+		named := []v2Rank{}
+		for i, period := range []struct {
+			name  string
+			cutAt func(time.Time) (time.Time, time.Time)
+		}{{"year", req.cal.Year}, {"month", req.cal.Month}, {"week", req.cal.Week}, {"day", req.cal.Day}} {
+			start, stop := period.cutAt(now)
+			named = append(named, v2Rank{v2Period: v2Period{Start: start, Stop: stop}, Name: period.name, Rank: ranks[i]})
+		}
+		meta, err := req.finalMeta()
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, v2RankResponse{Meta: meta, Subject: req.subject, Ranks: named, Total: ranks[4]})
+	}
+}
+
+// Gin handler function for the api v2 endpoint. Same as GetEnergySeries, each window with its start and stop.
+// It also works for the groups.
+// Access it with .../api/v2/users/:id/energy?from=2024-05-01T00:00:00Z&to=2024-05-08T00:00:00Z&step=1d&agg=mean
+func GetEnergySeriesV2(store model.SessionStore, energy model.EnergyStore, kind string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req, err := readV2Request(c, store, energy, kind)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		from, to, step, agg, err := querySeries(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		series, err := getEnergySeries(req.timeRanges, req.energy, req.filter, from, to, step, agg)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		windows := []v2Window{}
+		for _, p := range series {
+			stop := p.Timestamp.Add(step)
+			if stop.After(to) { //The last window is cut at to
+				stop = to
+			}
+			windows = append(windows, v2Window{v2Period: v2Period{Start: p.Timestamp, Stop: stop}, Value: p.Value, Count: p.Count})
+		}
+		meta, err := req.finalMeta()
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, v2SeriesResponse{Meta: meta, Subject: req.subject, Period: v2Period{Start: from, Stop: to},
+			Step: step.String(), Aggregate: agg, Windows: windows})
+	}
+}
@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"data_api/server/config"
+	"data_api/server/model"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A Calendar cuts the time in days, weeks (from Monday, like the ISO weeks), months and years as they are in a time zone,
+// so that "today" starts at midnight where the users are. The days around a change of daylight saving time
+// last 23 or 25 hours.
+type Calendar struct {
+	loc *time.Location
+}
+
+// Return the calendar of the time zone with this IANA name (like Europe/Paris), of DEFAULT_TIMEZONE if it is empty.
+// If it is unknown, the error wraps model.ErrInvalidInput.
+func NewCalendar(timezone string) (Calendar, error) {
+	if timezone == "" {
+		timezone = config.DEFAULT_TIMEZONE
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return Calendar{}, fmt.Errorf("%w: unknown time zone %q", model.ErrInvalidInput, timezone)
+	}
+	return Calendar{loc: loc}, nil
+}
+
+// Return the name of the time zone of the calendar, like Europe/Paris.
+func (c Calendar) Name() string {
+	return c.loc.String()
+}
+
+// Return the time t in the time zone of the calendar.
+func (c Calendar) In(t time.Time) time.Time {
+	return t.In(c.loc)
+}
+
+// Return the start of the day of t, and the start of the next one.
+func (c Calendar) Day(t time.Time) (time.Time, time.Time) {
+	y, m, d := t.In(c.loc).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, c.loc), time.Date(y, m, d+1, 0, 0, 0, 0, c.loc)
+}
+
+// Return the start of the week of t (the Monday), and the start of the next one.
+func (c Calendar) Week(t time.Time) (time.Time, time.Time) {
+	local := t.In(c.loc)
+	y, m, d := local.Date()
+	d -= (int(local.Weekday()) + 6) % 7 // Days since Monday, Sunday being the last day of the week
+	return time.Date(y, m, d, 0, 0, 0, 0, c.loc), time.Date(y, m, d+7, 0, 0, 0, 0, c.loc)
+}
+
+// Return the start of the month of t, and the start of the next one.
+func (c Calendar) Month(t time.Time) (time.Time, time.Time) {
+	y, m, _ := t.In(c.loc).Date()
+	return time.Date(y, m, 1, 0, 0, 0, 0, c.loc), time.Date(y, m+1, 1, 0, 0, 0, 0, c.loc)
+}
+
+// Return the start of the year of t, and the start of the next one.
+func (c Calendar) Year(t time.Time) (time.Time, time.Time) {
+	y := t.In(c.loc).Year()
+	return time.Date(y, time.January, 1, 0, 0, 0, 0, c.loc), time.Date(y+1, time.January, 1, 0, 0, 0, 0, c.loc)
+}
+
+// Return the calendar asked for by the request : the time zone given with ?tz=, else the one of the user
+// with the id userID points to (nil for none, like for the groups), else DEFAULT_TIMEZONE.
+func calendarFromQuery(c *gin.Context, store model.SessionStore, userID *int) (Calendar, error) {
+	timezone := c.Query("tz")
+	if timezone == "" && userID != nil {
+		user, err := store.GetUserById(*userID)
+		if err != nil {
+			return Calendar{}, err
+		}
+		timezone = user.Timezone
+	}
+	return NewCalendar(timezone)
+}
+
+// Read the day asked for with ?date=2024-05-01 (a day of the calendar), today if there is none.
+// If it is not a date or it is after today, the error wraps model.ErrInvalidInput.
+func queryDate(c *gin.Context, cal Calendar) (time.Time, error) {
+	value := c.Query("date")
+	if value == "" {
+		return time.Now(), nil
+	}
+	day, err := time.ParseInLocation(time.DateOnly, value, cal.loc)
+	if err != nil {
+		return day, fmt.Errorf("%w: the date %q is not like 2024-05-01", model.ErrInvalidInput, value)
+	}
+	if day.After(time.Now()) {
+		return day, fmt.Errorf("%w: the day %s has not started yet", model.ErrInvalidInput, value)
+	}
+	return day, nil
+}
+
+// Set the time zone the periods of the user start in, see model.SetUserTimezone.
+func SetUserTimezone(store model.SessionStore, id int, timezone string) error {
+	return store.SetUserTimezone(id, timezone)
+}
@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"data_api/server/model"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A SessionStore knowing only the users of the map, by id. The other methods are not used.
+type timezoneStore struct {
+	model.SessionStore
+	users map[int]model.User
+}
+
+func (s timezoneStore) GetUserById(id int) (model.User, error) {
+	if u, ok := s.users[id]; ok {
+		return u, nil
+	}
+	return model.User{}, model.ErrNotFound
+}
+
+func TestCalendarFromQuery(t *testing.T) {
+	store := timezoneStore{users: map[int]model.User{
+		0: {ID: 0, Timezone: "Europe/Paris"}, // The id 0 is a user like the others
+		1: {ID: 1},
+	}}
+	id := func(id int) *int { return &id }
+	cases := []struct {
+		name   string
+		query  string
+		userID *int
+		want   string
+	}{
+		{"no user", "", nil, "UTC"},
+		{"user 0", "", id(0), "Europe/Paris"},
+		{"user without time zone", "", id(1), "UTC"},
+		{"tz first", "?tz=America/New_York", id(0), "America/New_York"},
+		{"tz for a group", "?tz=Asia/Tokyo", nil, "Asia/Tokyo"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/"+tc.query, nil)
+			cal, err := calendarFromQuery(c, store, tc.userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cal.Name() != tc.want {
+				t.Errorf("time zone %s, want %s", cal.Name(), tc.want)
+			}
+		})
+	}
+}
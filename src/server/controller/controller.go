@@ -1,9 +1,11 @@
 package controller
 
 import (
+	"context"
+	"data_api/server/config"
 	"data_api/server/model"
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -16,136 +18,450 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// Connects to the postgres db, return a pointer to it
-func ConnectDB(username, password, host, port, dbname string) *sql.DB {
-	return model.ConnectDB(username, password, host, port, dbname)
+// Connects to the postgres store, return the session store using it
+func ConnectDB(username, password, host, port, dbname string) (model.SessionStore, error) {
+	return model.NewPostgresStore(username, password, host, port, dbname)
 }
 
-// Delete all tables inside the postgres db, you should use StartServer after this one to create them again
-func Reset(db *sql.DB) {
-	model.Reset(db)
+// Open the sqlite file at path (it is created if needed), return the session store using it
+func OpenSQLite(path string) (model.SessionStore, error) {
+	return model.NewSQLiteStore(path)
+}
+
+// Return the name used in the "host" tag of the points measured on this server :
+// config.HOST_NAME if it is set, else the hostname of the machine.
+func LocalHost() string {
+	if config.HOST_NAME != "" {
+		return config.HOST_NAME
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		log.Println("Couldn't get the hostname :", err)
+	}
+	return host
+}
+
+// Delete all tables inside the postgres store (except the audit log), you should use StartServer after this one to create them again.
+// actor is who asked for it, like for all the changes below, kept in the audit log
+func Reset(store model.SessionStore, actor string) error {
+	return store.Reset(actor)
 }
 
 // Create all the tables if it is the first time the server is launched,
 // else end all the previous user sessions that did not end correctly and start a new time-range with 0 users connected.
-func StartServer(db *sql.DB) {
-	model.DemarrageServeur(db)
+func StartServer(store model.SessionStore) error {
+	return store.DemarrageServeur()
 }
 
-// Connect a new user to the server, and return the id that was attributed
-func NewUserConnection(db *sql.DB) int {
-	return model.NewUserConnection(db)
+// Record every interval that the server is running, until ctx is cancelled (one last time then).
+// StartServer uses the last one to close the sessions left open by a crash.
+func RunHeartbeat(ctx context.Context, store model.SessionStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := store.Heartbeat(); err != nil {
+			log.Println("Heartbeat error:", err)
+		}
+		select {
+		case <-ctx.Done():
+			if err := store.Heartbeat(); err != nil {
+				log.Println("Heartbeat error:", err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Gin handler function for the api endpoint. Retrieve the periods during which the server was down,
+// from its last heartbeat to its restart.
+// Access it with .../downtimes
+func GetDowntimes(store model.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		downtimes, err := store.GetDowntimes()
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, downtimes)
+	}
+}
+
+// Handle the "migrate" command of the binary :
+//
+//	./main migrate up          apply all the pending migrations
+//	./main migrate down [n]    revert the n last migrations (1 by default)
+//	./main migrate status      list the migrations and when they were applied
+func MigrateCommand(store model.SessionStore, args []string) {
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "up":
+		n, err := store.Migrate()
+		fmt.Printf("%d migration(s) applied\n", n)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				log.Fatal("The number of migrations to revert must be a positive integer")
+			}
+		}
+		n, err := store.Rollback(steps)
+		fmt.Printf("%d migration(s) reverted\n", n)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "status":
+		states, err := store.MigrationStatus()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range states {
+			applied := "pending"
+			if s.AppliedAt.Valid {
+				applied = "applied " + s.AppliedAt.Time.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d %-30s %s\n", s.Version, s.Name, applied)
+		}
+	default:
+		log.Fatalf("Unknown migrate command %q, expected up, down or status", command)
+	}
+}
+
+// Connect a new user to the server, and return the id that was attributed.
+// info tells where the connection comes from, its host is this server if it is empty
+func NewUserConnection(store model.SessionStore, info model.SessionInfo, actor string) (int, error) {
+	return store.NewUserConnection(withLocalHost(info), actor)
 }
 
 // Connect an already known user to the server. If a user with this id does not exists yet, behave like NewUserConnection
-func UserConnection(db *sql.DB, id int) {
-	model.UserConnection(db, id)
+func UserConnection(store model.SessionStore, id int, info model.SessionInfo, actor string) error {
+	return store.UserConnection(id, withLocalHost(info), actor)
+}
+
+// Close a single session, the other sessions of its user stay open
+func CloseSession(store model.SessionStore, sessionID int, actor string) error {
+	return store.CloseSession(sessionID, actor)
+}
+
+// Same as CloseSession, at the time at (now if it is the zero time)
+func CloseSessionAt(store model.SessionStore, sessionID int, at time.Time, actor string) error {
+	return store.CloseSessionAt(sessionID, at, actor)
+}
+
+// Disconnect a user from the server, closing all their sessions. If the user wasn't connected, do nothing
+func UserDeconnection(store model.SessionStore, id int, actor string) error {
+	return store.UserDeconnection(id, actor)
+}
+
+// Connect the user known to the login hooks by an external identity (kind is "username", "ssh" or "oidc").
+// If nobody is known by it yet, a new user is created. Return the id of the user.
+func ExternalUserConnection(store model.SessionStore, kind, value string, info model.SessionInfo, actor string) (int, error) {
+	return store.ExternalUserConnection(model.Identity{Kind: kind, Value: value}, withLocalHost(info), actor)
 }
 
-// Disconnect a user from the server. If the user wasn't connected, do nothing
-func UserDeconnection(db *sql.DB, id int) {
-	model.UserDeconnection(db, id)
+// Return info, with this server as host if it has none.
+func withLocalHost(info model.SessionInfo) model.SessionInfo {
+	if info.Host == "" {
+		info.Host = LocalHost()
+	}
+	return info
+}
+
+// Disconnect the user known by an external identity. If the user wasn't connected, do nothing
+func ExternalUserDeconnection(store model.SessionStore, kind, value string, actor string) error {
+	return store.ExternalUserDeconnection(model.Identity{Kind: kind, Value: value}, actor)
+}
+
+// Give one more external identity to the user with this id
+func AddIdentity(store model.SessionStore, id int, kind, value string) error {
+	return store.AddIdentity(id, model.Identity{Kind: kind, Value: value})
+}
+
+// Set the display name, team and labels of the user with this id
+func UpdateUserProfile(store model.SessionStore, id int, displayName, team string, labels map[string]string) error {
+	return store.UpdateUserProfile(id, displayName, team, labels)
 }
 
 // Gin handler function for the api endpoint. Show the list of all the users known by the server in a json.
 // Access it with .../users
-func GetUsers(db *sql.DB) gin.HandlerFunc {
+func GetUsers(store model.SessionStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		users := model.GetUsers(db)
+		users, err := store.GetUsers()
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
 		c.IndentedJSON(http.StatusOK, users)
 	}
 }
 
 // Gin handler function for the api endpoint. Retrieve a specific user by the id specified in the url.
 // Access it with .../users/:id
-func GetUserById(db *sql.DB) gin.HandlerFunc {
+func GetUserById(store model.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		user, err := store.GetUserById(id)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, user)
+	}
+}
+
+// Gin handler function for the api endpoint. Retrieve the user known by an external identity, given in the query
+// since the ssh fingerprints contain slashes.
+// Access it with .../users/lookup?kind=username&value=alice
+func GetUserByExternalID(store model.SessionStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		id, _ := strconv.Atoi(c.Param("id"))
-		user := model.GetUserById(db, id)
+		user, err := store.GetUserByExternalID(model.Identity{Kind: c.Query("kind"), Value: c.Query("value")})
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
 		c.IndentedJSON(http.StatusOK, user)
 	}
 }
 
 // Gin handler function for the api endpoint. Retrieve all the links associated with the user specified by the id in the url.
 // Access it with .../users/:id/links
-func GetUserTimesById(db *sql.DB) gin.HandlerFunc {
+func GetUserTimesById(store model.SessionStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		id, _ := strconv.Atoi(c.Param("id"))
-		userTimes := model.GetUserTimesById(db, id)
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		userTimes, err := store.GetUserTimesById(id)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
 		c.IndentedJSON(http.StatusOK, userTimes)
 	}
 }
 
 // Gin handler function for the api endpoint. Retrieve all the time-ranges since the start of the server.
 // Access it with .../plages
-func GetTimeRanges(db *sql.DB) gin.HandlerFunc {
+func GetTimeRanges(store model.SessionStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		timeRanges := model.GetTimeRanges(db)
+		timeRanges, err := store.GetTimeRanges()
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
 		c.IndentedJSON(http.StatusOK, timeRanges)
 	}
 }
 
 // Gin handler function for the api endpoint. Retrieve a specific time-range by the id specified in the url.
 // Access it with .../plages/:id
-func GetTimerangeById(db *sql.DB) gin.HandlerFunc {
+func GetTimerangeById(store model.SessionStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		id, _ := strconv.Atoi(c.Param("id"))
-		timeRange := model.GetTimerangeById(db, id)
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		timeRange, err := store.GetTimerangeById(id)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
 		c.IndentedJSON(http.StatusOK, timeRange)
 	}
 }
 
-// Gin handler function for the api endpoint. Retrieve some key data about today's consumption.
-// Access it with .../users/:id/today
-func GetTodayHighlights(db *sql.DB, bucket, org, token, url string) gin.HandlerFunc {
-	year := time.Now().Year()
-	month := time.Now().Month()
-	day := time.Now().Day()
+// Gin handler function for the api endpoint. Retrieve some key data about the consumption of today, or of the day given
+// with date : the highest and the lowest points, the sum and the mean, in an array (see DayHighlights.points).
+// The day starts at midnight in the time zone given with tz, else in the one of the user, see calendarFromQuery.
+// Access it with .../users/:id/today or .../users/:id/today?date=2024-05-01&tz=Europe/Paris
+func GetTodayHighlights(store model.SessionStore, energy model.EnergyStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		id, _ := strconv.Atoi(c.Param("id"))
-		today := getTodayHighlights(id, year, day, month, db, bucket, org, token, url)
-		c.IndentedJSON(http.StatusOK, today)
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		filter := tagsFromQuery(c)
+		cal, err := calendarFromQuery(c, store, &id)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		timeRanges, err := getUserTimes(id, store)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		day, err := queryDate(c, cal)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		highlights, err := getDayHighlights(cal, day, timeRanges, energy, filter)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, highlights.points())
 	}
 }
 
 // Gin handler func : Return a list of all the daily average consumptions since the first connection of the user to the server.
+// The days start at midnight in the time zone given with tz, like for GetTodayHighlights.
 // Access it with .../users/:id/consumption
-func GetAllDailyMean(db *sql.DB, bucket, org, token, url string) gin.HandlerFunc {
+func GetAllDailyMean(store model.SessionStore, energy model.EnergyStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		id, _ := strconv.Atoi(c.Param("id"))
-		dailyMeans := getAllDailyMean(id, db, bucket, org, token, url)
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		filter := tagsFromQuery(c)
+		cal, err := calendarFromQuery(c, store, &id)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		timeRanges, err := getUserTimes(id, store)
+		if err == nil && len(timeRanges) == 0 {
+			err = fmt.Errorf("%w: user %d has never been connected", model.ErrNotFound, id)
+		}
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		dailyMeans, err := getAllDailyMean(cal, timeRanges, energy, filter)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
 		c.IndentedJSON(http.StatusOK, dailyMeans)
 	}
 }
 
-// Return a gin function that gives the average consumption of each of the 52 last weeks
+// Return a gin function that gives the average consumption of each of the 52 last weeks, from Monday
+// in the time zone given with tz, like for GetTodayHighlights.
 // Access it with .../users/:id/weeklyMean
-func GetWeeklyMean(db *sql.DB, bucket, org, token, url string) gin.HandlerFunc {
+func GetWeeklyMean(store model.SessionStore, energy model.EnergyStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		id, _ := strconv.Atoi(c.Param("id"))
-		weeklyMean := getAllWeeklyMeans(id, db, bucket, org, token, url)
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		filter := tagsFromQuery(c)
+		cal, err := calendarFromQuery(c, store, &id)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		timeRanges, err := getUserTimes(id, store)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		weeklyMean, err := getAllWeeklyMeans(cal, timeRanges, energy, filter)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
 		c.IndentedJSON(http.StatusOK, weeklyMean)
 	}
 }
 
 // Gin handler function for the api endpoint. Retrieve the rank of the user specified by the id in the url
 // among all the users of the server. There are four ranks, corresponding respectively to the :
-// rank over this year, this month, this week and today.
+// rank over this year, this month, this week and today. The periods start in the time zone given with tz (else the one of the user),
+// the same for all the users compared.
 // Access it with .../users/:id/rank
-func GetRank(db *sql.DB, bucket, org, token, url string) gin.HandlerFunc {
+func GetRank(store model.SessionStore, energy model.EnergyStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		id, _ := strconv.Atoi(c.Param("id"))
-		ranks := RankUser(id, db, bucket, org, token, url)
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		filter := tagsFromQuery(c)
+		cal, err := calendarFromQuery(c, store, &id)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		ranks, err := RankUser(id, store, energy, filter, cal)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
 		c.IndentedJSON(http.StatusOK, ranks)
 	}
 }
 
-func getUserTimes(id int, db *sql.DB) (timeRanges []model.TimeRange) {
-	timeRanges = model.GetUserTimes(db, id)
-	return timeRanges
+// Read the :id parameter of the url. Return an error wrapping model.ErrInvalidInput if it is not an integer.
+func paramID(c *gin.Context) (int, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return 0, fmt.Errorf("%w: the id %q is not an integer", model.ErrInvalidInput, c.Param("id"))
+	}
+	return id, nil
+}
+
+// Stop the request and answer with the json {"error": ...} matching err :
+// 404 if something asked for doesn't exist, 400 if the request is invalid, 503 if a database can't be reached,
+// and 500 otherwise. The details of the last two are only logged, since they can tell about the databases.
+func abortWithError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, model.ErrNotFound):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, model.ErrInvalidInput):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, model.ErrUnavailable):
+		log.Printf("%s %s: %v\n", c.Request.Method, c.Request.URL.Path, err)
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": model.ErrUnavailable.Error()})
+	default:
+		log.Printf("%s %s: %v\n", c.Request.Method, c.Request.URL.Path, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+	}
+}
+
+// Read the tags used to filter the energy points from the query parameters of the request
+// (?host=...&source=...&domain=...&unit=...&process=...).
+// If no host is given, the points of every host are used, including the ones without a host tag (older points, fake data).
+func tagsFromQuery(c *gin.Context) model.Tags {
+	return model.Tags{
+		Host:    c.Query("host"),
+		Source:  c.Query("source"),
+		Domain:  c.Query("domain"),
+		Unit:    c.Query("unit"),
+		Process: c.Query("process"),
+	}
+}
+
+// Return the precision needed when reading the points of a time-range between start and stop. A rollup window that
+// straddles a limit of the range is attributed to it entirely, so the windows must stay small compared to the range.
+func resolutionFor(start, stop time.Time) time.Duration {
+	return stop.Sub(start) / 60
+}
+
+func getUserTimes(id int, store model.SessionStore) (timeRanges []model.TimeRange, err error) {
+	timeRanges, err = store.GetUserTimes(id)
+	return timeRanges, err
 }
 
-func worker(tasks <-chan model.TimeRange, results chan<- []model.Point, wg *sync.WaitGroup, bucket, org, token, url string) {
+func worker(tasks <-chan model.TimeRange, results chan<- []model.Point, errs chan<- error, wg *sync.WaitGroup, energy model.EnergyStore, filter model.Tags,
+	resolution func(start, stop time.Time) time.Duration) {
 	defer wg.Done()
 	for t := range tasks {
 		start := t.Start
@@ -154,31 +470,48 @@ func worker(tasks <-chan model.TimeRange, results chan<- []model.Point, wg *sync
 			stop = t.Stop.Time
 		}
 
-		influxData := model.GetData(bucket, org, token, url, start, stop)
+		influxData, err := energy.GetData(start, stop, resolution(start, stop), filter)
+		if err != nil {
+			errs <- err
+			continue
+		}
 		for i, elt := range influxData {
-			influxData[i] = model.Point{Timestamp: elt.Timestamp, Value: elt.Value / float64(t.NbrUsers)}
+			influxData[i] = elt.Scaled(t.Share(config.ATTRIBUTION))
 		}
 
 		results <- influxData
 	}
 }
 
-// Get all the points stored in the influx db during the time when the user was connected.
+// Get all the points stored in the energy database during the time when the user was connected.
+func getUserEnergyConsumption(id int, store model.SessionStore, energy model.EnergyStore, filter model.Tags) ([]model.Point, error) {
+	timeRanges, err := getUserTimes(id, store) //get all the time-ranges during which the user was connected
+	if err != nil {
+		return nil, err
+	}
+	return getEnergyConsumption(timeRanges, energy, filter)
+}
+
+// Get the share of the points stored in the energy database during each of the time-ranges.
 // It uses the subfunction worker to parallelize and accelerate the process.
-func getUserEnergyConsumption(id int, db *sql.DB, bucket, org, token, url string) []model.Point {
-	defer model.CloseClient()
+func getEnergyConsumption(timeRanges []model.TimeRange, energy model.EnergyStore, filter model.Tags) ([]model.Point, error) {
+	return getEnergyConsumptionAt(timeRanges, energy, filter, resolutionFor)
+}
 
+// Same as getEnergyConsumption, with the points of each time-range read at the precision given by resolution.
+func getEnergyConsumptionAt(timeRanges []model.TimeRange, energy model.EnergyStore, filter model.Tags,
+	resolution func(start, stop time.Time) time.Duration) ([]model.Point, error) {
 	var userEnergyC []model.Point
-	timeRanges := getUserTimes(id, db) //get all the time-ranges during which the user was connected
 
 	nbrWorkers := 5
 	tasks := make(chan model.TimeRange, len(timeRanges))
 	results := make(chan []model.Point, len(timeRanges))
+	errs := make(chan error, len(timeRanges))
 	var wg sync.WaitGroup
 
 	for i := 0; i < nbrWorkers; i++ {
 		wg.Add(1)
-		go worker(tasks, results, &wg, bucket, org, token, url)
+		go worker(tasks, results, errs, &wg, energy, filter, resolution)
 	}
 
 	go func() {
@@ -191,85 +524,112 @@ func getUserEnergyConsumption(id int, db *sql.DB, bucket, org, token, url string
 	go func() {
 		wg.Wait()
 		close(results)
-		model.CloseClient()
 	}()
 
 	for influxData := range results {
 		userEnergyC = append(userEnergyC, influxData...)
 	}
+	select {
+	case err := <-errs: //Only the first error is returned, the points are incomplete anyway
+		return nil, err
+	default:
+	}
 
 	// Allow to create a json file with all data
 	//name := fmt.Sprintf("outputUser%d.json", id)
 	//createJSONFile(name, userEnergyC)
 
-	return userEnergyC
+	return userEnergyC, nil
 }
 
-// Return a list of all the daily average consumptions since the first connection of the user to the server.
-func getAllDailyMean(id int, db *sql.DB, bucket, org, token, url string) []model.Point {
-	defer model.CloseClient()
-
-	var result []model.Point
-
-	firstTimeRange := model.GetEarliestTimeRange(id, db)
+// Return a list of all the daily average consumptions since the first of the time-ranges (the first connection of the user to the server),
+// the days starting at midnight in the calendar.
+func getAllDailyMean(cal Calendar, timeRanges []model.TimeRange, energy model.EnergyStore, filter model.Tags) ([]model.Point, error) {
+	result := []model.Point{}
+	if len(timeRanges) == 0 {
+		return result, nil
+	}
 
-	year := firstTimeRange.Start.Year()
-	month := firstTimeRange.Start.Month()
-	day := firstTimeRange.Start.Day()
+	first := timeRanges[0].Start
+	for _, t := range timeRanges {
+		if t.Start.Before(first) {
+			first = t.Start
+		}
+	}
 
-	curDay := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	curDay, _ := cal.Day(first)
 	for curDay.Before(time.Now()) {
-		result = append(result, getTodayHighlights(id, year, day, month, db, bucket, org, token, url)[3])
-		curDay = curDay.Add(24 * time.Hour)
-		year = curDay.Year()
-		month = curDay.Month()
-		day = curDay.Day()
+		highlights, err := getDayHighlights(cal, curDay, timeRanges, energy, filter)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, model.Point{Timestamp: highlights.Day, Value: highlights.Mean})
+		_, curDay = cal.Day(curDay)
 	}
 
-	return result
+	return result, nil
 }
 
 // UNUSED Gin handler function for the api endpoint. Return a list of all the points corresponding to the energy consumption of the user.
-func GetUserEnergyConsumption(db *sql.DB, bucket, org, token, url string) gin.HandlerFunc {
+func GetUserEnergyConsumption(store model.SessionStore, energy model.EnergyStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		id, err := strconv.Atoi(c.Param("id"))
+		id, err := paramID(c)
 		if err != nil {
-			fmt.Println(err)
+			abortWithError(c, err)
+			return
+		}
+		filter := tagsFromQuery(c)
+		points, err := getUserEnergyConsumption(id, store, energy, filter)
+		if err != nil {
+			abortWithError(c, err)
+			return
 		}
-		points := getUserEnergyConsumption(id, db, bucket, org, token, url)
 		c.IndentedJSON(http.StatusOK, points)
 	}
 }
 
-// Delete the user specified by id
-func DeleteUser(db *sql.DB, id int) {
-	model.DeleteUser(db, id)
+// Delete the user specified by id and everything tied to it, see EraseUser for the other ways to erase a user
+func DeleteUser(store model.SessionStore, id int, actor, reason string) error {
+	_, err := store.EraseUser(id, model.EraseDelete, actor, reason)
+	return err
 }
 
 // Allow to create a json file from a list of points. Can be useful for debugging but is unused otherwise.
-func createJSONFile(name string, data []model.Point) {
-	f, _ := os.Create(name)
+func createJSONFile(name string, data []model.Point) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
 	defer f.Close()
-	var jsonData []byte
-	var err error
-	if jsonData, err = json.MarshalIndent(data, "", "\t"); err != nil {
-		log.Fatal(err)
+	jsonData, err := json.MarshalIndent(data, "", "\t")
+	if err != nil {
+		return err
 	}
-	f.Write(jsonData)
+	_, err = f.Write(jsonData)
+	return err
 }
 
-// Return an array of points (timestamp, value) corresponding to :
-//
-// today's maximum consumption, minimum consumption, total consumption, and average consumption.
-func getTodayHighlights(id, year, day int, month time.Month, db *sql.DB, bucket, org, token, url string) []model.Point {
+// The key data about the consumption of a day.
+type DayHighlights struct {
+	Day  time.Time   `json:"day"`  // Midnight at the start of the day, in the time zone of the calendar
+	Max  model.Point `json:"max"`  // The point with the highest consumption, and when it was measured
+	Min  model.Point `json:"min"`  // The point with the lowest consumption
+	Sum  float64     `json:"sum"`  // The consumption of the whole day
+	Mean float64     `json:"mean"` // The consumption per point
+}
+
+// Return the highlights as the endpoints without /api/v2 always answered them, for the older clients : an array of points
+// (timestamp, value) with the maximum, the minimum, the sum and the mean, the last two timestamped with the start of the day.
+func (h DayHighlights) points() []model.Point {
+	return []model.Point{h.Max, h.Min, {Timestamp: h.Day, Value: h.Sum}, {Timestamp: h.Day, Value: h.Mean}}
+}
 
-	defer model.CloseClient()
+// Return the maximum consumption, minimum consumption, total consumption, and average consumption of the day containing day in the calendar.
+func getDayHighlights(cal Calendar, day time.Time, timeRanges []model.TimeRange, energy model.EnergyStore, filter model.Tags) (DayHighlights, error) {
 
-	today := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
-	maxMinSumMean := []model.Point{{Timestamp: today, Value: 0}, {Timestamp: today, Value: 1000},
-		{Timestamp: today, Value: 0}, {Timestamp: today, Value: 0}}
+	today, tomorrow := cal.Day(day)
+	highlights := DayHighlights{Day: today, Max: model.Point{Timestamp: today, Value: 0}, Min: model.Point{Timestamp: today, Value: 1000}}
 	meanDivider := 0
-	timeRanges := getUserTimes(id, db)
 
 	for _, t := range timeRanges {
 		start := t.Start
@@ -278,71 +638,75 @@ func getTodayHighlights(id, year, day int, month time.Month, db *sql.DB, bucket,
 			stop = t.Stop.Time
 		}
 
-		if t.Stop.Time.Before(today) || start.After(today.Add(24*time.Hour)) {
+		if stop.Before(today) || !start.Before(tomorrow) {
 			continue
 		}
-		influxData := model.GetData(bucket, org, token, url, start, stop)
+		//The max and min need the raw points, or the max and min of the finest rollups once the raw points are deleted
+		influxData, err := energy.GetData(start, stop, 0, filter)
+		if err != nil {
+			return DayHighlights{}, err
+		}
 
 		for _, elt := range influxData {
-			if elt.Timestamp.Before(today.Add(24*time.Hour)) && elt.Timestamp.After(today) {
+			if elt.Timestamp.Before(tomorrow) && !elt.Timestamp.Before(today) {
 
-				elt.Value = elt.Value / float64(t.NbrUsers)
+				elt = elt.Scaled(t.Share(config.ATTRIBUTION))
 
-				if elt.Value > maxMinSumMean[0].Value {
-					maxMinSumMean[0] = elt
-				} else if elt.Value < maxMinSumMean[1].Value {
-					maxMinSumMean[1] = elt
+				high, low := elt.Extremes()
+				if high > highlights.Max.Value {
+					highlights.Max = model.Point{Timestamp: elt.Timestamp, Value: high, Tags: elt.Tags}
+				}
+				if low < highlights.Min.Value {
+					highlights.Min = model.Point{Timestamp: elt.Timestamp, Value: low, Tags: elt.Tags}
 				}
 
-				maxMinSumMean[2].Value += elt.Value
-				maxMinSumMean[3].Value += elt.Value
-				meanDivider++
+				highlights.Sum += elt.Value
+				meanDivider += elt.Weight()
 			}
 		}
 	}
-	if maxMinSumMean[1].Value == 1000 {
-		maxMinSumMean[1].Value = 0
+	if highlights.Min.Value == 1000 {
+		highlights.Min.Value = 0
 	}
 	if meanDivider > 0 {
-		maxMinSumMean[3].Value /= float64(meanDivider)
+		highlights.Mean = highlights.Sum / float64(meanDivider)
 	}
 
-	return maxMinSumMean
+	return highlights, nil
 }
 
-// Return an array with the average consumption (per 10s passed on the server) of each of the last 52 weeks.
+// Return an array with the average consumption (per 10s passed on the server) of each of the last 52 weeks of the calendar.
 // The first element of the array is the mean consumption of the actual, ongoing week.
-func getAllWeeklyMeans(id int, db *sql.DB, bucket, org, token, url string) [52]float64 {
-
-	defer model.CloseClient()
+func getAllWeeklyMeans(cal Calendar, timeRanges []model.TimeRange, energy model.EnergyStore, filter model.Tags) ([52]float64, error) {
 
 	weeklyMeansTemp := [52]struct {
 		float64 //The sum value of cpu consumption during that week
 		int     //The number of points to divide with to obtain the mean
 	}{}
 	dates := [][]time.Time{}
-	t := time.Now().UTC()
+	t := time.Now()
 
-	//Create the week intervals
-	today := t.Weekday()
-	mondayGap := int(today) - 1
-	mondayTime := t.Add(-time.Duration(mondayGap*24) * time.Hour).Add(-time.Duration(t.Hour())*time.Hour - time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second)
+	//Create the week intervals, from Monday to Monday (a week with a change of daylight saving time lasts an hour more or less)
+	mondayTime, _ := cal.Week(t)
 	dates = append(dates, []time.Time{mondayTime, t})
 	for range 51 {
-		newMondayTime := mondayTime.Add(-time.Duration(7*24) * time.Hour)
+		newMondayTime := mondayTime.AddDate(0, 0, -7)
 		dates = append(dates, []time.Time{newMondayTime, mondayTime})
 		mondayTime = newMondayTime
 	}
 
 	//Get all data points of the user
-	globalUserConsumption := getUserEnergyConsumption(id, db, bucket, org, token, url)
+	globalUserConsumption, err := getEnergyConsumption(timeRanges, energy, filter)
+	if err != nil {
+		return [52]float64{}, err
+	}
 
 	//Get the data corresponding to the intervals
 	for _, point := range globalUserConsumption {
 		for i, week := range dates {
-			if point.Timestamp.Before(week[1]) && point.Timestamp.After(week[0]) {
+			if point.Timestamp.Before(week[1]) && !point.Timestamp.Before(week[0]) {
 				weeklyMeansTemp[i].float64 += point.Value
-				weeklyMeansTemp[i].int++ //The coefficient to divide with depends on the number of points,
+				weeklyMeansTemp[i].int += point.Weight() //The coefficient to divide with depends on the number of points,
 				// so the mean depends on the monitoring frequency
 				break //Only breaks inner loop (hopefully)
 			}
@@ -359,147 +723,81 @@ func getAllWeeklyMeans(id int, db *sql.DB, bucket, org, token, url string) [52]f
 		}
 	}
 
-	return weeklyMeans
+	return weeklyMeans, nil
 
 }
 
-// Return the average consumption (per 10s passed on the server) of this week (from Monday to today)
-func getWeeklyMean(id int, db *sql.DB, bucket, org, token, url string) float64 {
+// Return the average consumption (per 10s passed on the server) between from and to, like from the start of the week,
+// of the month or of the year to now.
+func getMeanBetween(from, to time.Time, timeRanges []model.TimeRange, energy model.EnergyStore, filter model.Tags) (float64, error) {
 
-	defer model.CloseClient()
 	var result float64
 	var allPoints []model.Point
 
-	now := time.Now().UTC()
-	//Create the week interval
-	today := now.Weekday()
-	mondayGap := int(today) - 1
-	mondayTime := now.Add(-time.Duration(mondayGap*24) * time.Hour).Add(-time.Duration(now.Hour())*time.Hour - time.Duration(now.Minute())*time.Minute - time.Duration(now.Second())*time.Second)
-
-	timeRanges := getUserTimes(id, db)
-
 	for _, t := range timeRanges {
 
+		//Only the part of the time-range inside the period
 		start := t.Start
-		stop := now
+		stop := time.Now()
 		if t.Stop.Valid {
 			stop = t.Stop.Time
 		}
-
-		if t.Stop.Time.Before(mondayTime) || start.After(now) {
-			continue
-		}
-
-		for _, elt := range model.GetData(bucket, org, token, url, start, stop) {
-			allPoints = append(allPoints, model.Point{Timestamp: elt.Timestamp, Value: elt.Value / float64(t.NbrUsers)})
+		if start.Before(from) {
+			start = from
 		}
-	}
-	for _, elt := range allPoints {
-		result += elt.Value
-	}
-	if result != 0 {
-		result /= float64(len(allPoints))
-	}
-
-	return result
-}
-
-// Return the average month consumption (per 10s passed on the server) for this month (from the 1st of the month to today)
-func getMonthlyMean(id int, db *sql.DB, bucket, org, token, url string) float64 {
-
-	defer model.CloseClient()
-	var result float64
-	var allPoints []model.Point
-
-	now := time.Now().UTC()
-	//Create the month interval
-	today := now.Day()
-	monthGap := int(today) - 1
-	monthTime := now.Add(-time.Duration(monthGap*24) * time.Hour).Add(-time.Duration(now.Hour())*time.Hour - time.Duration(now.Minute())*time.Minute - time.Duration(now.Second())*time.Second)
-
-	timeRanges := getUserTimes(id, db)
-	for _, t := range timeRanges {
-
-		start := t.Start
-		stop := now
-		if t.Stop.Valid {
-			stop = t.Stop.Time
+		if stop.After(to) {
+			stop = to
 		}
 
-		if t.Stop.Time.Before(monthTime) || start.After(now) {
+		if !start.Before(stop) {
 			continue
 		}
 
-		for _, elt := range model.GetData(bucket, org, token, url, start, stop) {
-			allPoints = append(allPoints, model.Point{Timestamp: elt.Timestamp, Value: elt.Value / float64(t.NbrUsers)})
-		}
-	}
-	for _, elt := range allPoints {
-		result += elt.Value
-	}
-	if result != 0 {
-		result /= float64(len(allPoints))
-	}
-
-	return result
-}
-
-// Return the average consumption (per 10s passed on the server) during this civil year (from January, 1st to today)
-func getYearlyMean(id int, db *sql.DB, bucket, org, token, url string) float64 {
-
-	defer model.CloseClient()
-	var result float64
-	var allPoints []model.Point
-
-	now := time.Now().UTC()
-
-	//Create the year interval
-	yearTime := time.Date(time.Now().Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
-
-	timeRanges := getUserTimes(id, db)
-
-	for _, t := range timeRanges {
-
-		start := t.Start
-		stop := now
-		if t.Stop.Valid {
-			stop = t.Stop.Time
-		}
-
-		if t.Stop.Time.Before(yearTime) || start.After(now) {
-			continue
+		points, err := energy.GetData(start, stop, resolutionFor(start, stop), filter)
+		if err != nil {
+			return 0, err
 		}
-
-		for _, elt := range model.GetData(bucket, org, token, url, start, stop) {
-			allPoints = append(allPoints, model.Point{Timestamp: elt.Timestamp, Value: elt.Value / float64(t.NbrUsers)})
+		for _, elt := range points {
+			allPoints = append(allPoints, elt.Scaled(t.Share(config.ATTRIBUTION)))
 		}
 	}
+	nbrPoints := 0
 	for _, elt := range allPoints {
 		result += elt.Value
+		nbrPoints += elt.Weight()
 	}
 	if result != 0 {
-		result /= float64(len(allPoints))
+		result /= float64(nbrPoints)
 	}
 
-	return result
+	return result, nil
 }
 
-// Return means in the following order : mean over the year, mean over the last month, over the last
-// week and over the last day (!not the last 24h!).
+// Return the means of the user connected during timeRanges in the following order : mean over the year, mean over the month, over the
+// week and over the day (!not the last 24h!), each one from its start in the calendar to now.
 // All means are expressed in mWh/10s or J/10s depending of the version (so the average consumption for 10s passed on the server).
-func getAllMeans(id int, db *sql.DB, bucket, org, token, url string) []float64 {
+func getAllMeans(cal Calendar, timeRanges []model.TimeRange, energy model.EnergyStore, filter model.Tags) ([]float64, error) {
 
 	yMWDMeans := []float64{}
 
-	yMWDMeans = append(yMWDMeans, getYearlyMean(id, db, bucket, org, token, url))
-	yMWDMeans = append(yMWDMeans, getMonthlyMean(id, db, bucket, org, token, url))
-	yMWDMeans = append(yMWDMeans, getWeeklyMean(id, db, bucket, org, token, url))
-	year := time.Now().Year()
-	month := time.Now().Month()
-	day := time.Now().Day()
-	yMWDMeans = append(yMWDMeans, getTodayHighlights(id, year, day, month, db, bucket, org, token, url)[3].Value)
+	now := time.Now()
+	year, _ := cal.Year(now)
+	month, _ := cal.Month(now)
+	week, _ := cal.Week(now)
+	for _, start := range []time.Time{year, month, week} {
+		value, err := getMeanBetween(start, now, timeRanges, energy, filter)
+		if err != nil {
+			return nil, err
+		}
+		yMWDMeans = append(yMWDMeans, value)
+	}
+	today, err := getDayHighlights(cal, now, timeRanges, energy, filter)
+	if err != nil {
+		return nil, err
+	}
+	yMWDMeans = append(yMWDMeans, today.Mean)
 
-	return yMWDMeans
+	return yMWDMeans, nil
 }
 
 // Return an array with the different rankings of the user with id "id".
@@ -507,8 +805,28 @@ func getAllMeans(id int, db *sql.DB, bucket, org, token, url string) []float64 {
 // Since the consumption can vary depending of the time of the year, this program computes the rank for different periods of time.
 // It also add the total number of users, to allow comparisons and percentages.
 // The elements of the array corresponds respectively to : the year rank, the month rank, the week rank,
-// the daily rank and the total number of users in the database.
-func RankUser(id int, db *sql.DB, bucket, org, token, url string) []int {
+// the daily rank and the total number of users in the database. The periods start in the calendar cal.
+// If the user is not registered, the error wraps model.ErrNotFound.
+func RankUser(id int, store model.SessionStore, energy model.EnergyStore, filter model.Tags, cal Calendar) ([]int, error) {
+	ids, err := store.GetUsersIDs()
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(ids, id) {
+		return nil, fmt.Errorf("%w: user %d is not registered in the database", model.ErrNotFound, id)
+	}
+
+	allTimeRanges, err := store.GetAllUserTimes() //A single query for the time-ranges of every user
+	if err != nil {
+		return nil, err
+	}
+
+	return rank(id, ids, allTimeRanges, energy, filter, cal)
+}
+
+// Return the ranks of id among ids (users or groups), each of them being connected during its allTimeRanges.
+// See RankUser for the order of the ranks.
+func rank(id int, ids []int, allTimeRanges map[int][]model.TimeRange, energy model.EnergyStore, filter model.Tags, cal Calendar) ([]int, error) {
 
 	type Mean struct {
 		value float64
@@ -520,20 +838,17 @@ func RankUser(id int, db *sql.DB, bucket, org, token, url string) []int {
 	monthMeans := []Mean{}
 	weekMeans := []Mean{}
 	dayMeans := []Mean{}
-	ids := model.GetUsersIDs(db)
-	if !slices.Contains(ids, id) {
-		fmt.Println("This user is not registered in the database ! ")
-		log.Fatal()
-	}
 
 	for _, id := range ids {
-		temp := getAllMeans(id, db, bucket, org, token, url)
+		temp, err := getAllMeans(cal, allTimeRanges[id], energy, filter)
+		if err != nil {
+			return nil, err
+		}
 		yearMeans = append(yearMeans, Mean{value: temp[0], id: id})
 		monthMeans = append(monthMeans, Mean{value: temp[1], id: id})
 		weekMeans = append(weekMeans, Mean{value: temp[2], id: id})
 		dayMeans = append(dayMeans, Mean{value: temp[3], id: id})
 	}
-
 	cmp := func(i, j Mean) int {
 		if i.value == j.value {
 			return 0
@@ -560,5 +875,5 @@ func RankUser(id int, db *sql.DB, bucket, org, token, url string) []int {
 
 	ranks = append(ranks, yearRank, monthRank, weekRank, dayRank, nbrUsers)
 
-	return ranks
+	return ranks, nil
 }
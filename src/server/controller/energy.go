@@ -0,0 +1,194 @@
+package controller
+
+import (
+	"bytes"
+	"data_api/server/model"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The ways to aggregate the points of a window of an energy series.
+const (
+	AggSum  = "sum"
+	AggMean = "mean" // Per raw point, like the daily and weekly means
+	AggMax  = "max"
+	AggMin  = "min"
+)
+
+var aggregates = []string{AggSum, AggMean, AggMax, AggMin}
+
+// Most windows a series can have, so that a tiny step over years doesn't hold the server.
+const maxSeriesWindows = 10000
+
+// Parse the step of a series : a go duration (15m, 1h30m...), or a whole number of days (1d) or weeks (1w).
+func parseStep(value string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(value, suffix); ok {
+			if count, err := strconv.Atoi(n); err == nil {
+				return time.Duration(count) * unit, nil
+			}
+		}
+	}
+	return time.ParseDuration(value)
+}
+
+// Return the consumption attributed to the user of the time-ranges between from and to, in windows of step starting
+// at from (the last one is cut at to). Each point is the start of a window, the aggregate agg of the points in it,
+// and the number of raw points they stand for ; a window without points has 0 for both.
+func getEnergySeries(timeRanges []model.TimeRange, energy model.EnergyStore, filter model.Tags, from, to time.Time, step time.Duration, agg string) ([]model.Point, error) {
+	series := make([]model.Point, int((to.Sub(from)+step-1)/step))
+	for i := range series {
+		series[i].Timestamp = from.Add(time.Duration(i) * step)
+	}
+
+	// Only the part of each time-range inside the series is read
+	clipped := []model.TimeRange{}
+	for _, t := range timeRanges {
+		stop := time.Now()
+		if t.Stop.Valid {
+			stop = t.Stop.Time
+		}
+		if t.Start.Before(from) {
+			t.Start = from
+		}
+		if stop.After(to) {
+			stop = to
+		}
+		if !t.Start.Before(stop) {
+			continue
+		}
+		t.Stop = sql.NullTime{Time: stop, Valid: true}
+		clipped = append(clipped, t)
+	}
+
+	// The max and min need the raw points (or the finest rollups once they are deleted), the sums only a precision
+	// small compared to the windows
+	resolution := func(start, stop time.Time) time.Duration {
+		if agg == AggMax || agg == AggMin {
+			return 0
+		}
+		return min(resolutionFor(start, stop), step/60)
+	}
+	points, err := getEnergyConsumptionAt(clipped, energy, filter, resolution)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range points {
+		if p.Timestamp.Before(from) || !p.Timestamp.Before(to) {
+			continue
+		}
+		w := &series[p.Timestamp.Sub(from)/step]
+		high, low := p.Extremes()
+		switch {
+		case agg == AggMax && (w.Count == 0 || high > w.Value):
+			w.Value = high
+		case agg == AggMin && (w.Count == 0 || low < w.Value):
+			w.Value = low
+		case agg == AggSum || agg == AggMean:
+			w.Value += p.Value
+		}
+		w.Count += p.Weight()
+	}
+	if agg == AggMean {
+		for i := range series {
+			if series[i].Count > 0 {
+				series[i].Value /= float64(series[i].Count)
+			}
+		}
+	}
+	return series, nil
+}
+
+// Gin handler function for the api endpoint. Retrieve the consumption of the user over any period, as a series :
+// from and to are RFC 3339 times (the last 24 hours by default), step the width of the windows (1h by default,
+// a go duration like 15m or a number of days like 1d or weeks like 1w) and agg the aggregate of each window
+// (sum by default, mean, max or min). The consumption is shared like for the other endpoints.
+// Access it with .../users/:id/energy?from=2024-05-01T00:00:00Z&to=2024-05-08T00:00:00Z&step=1d&agg=mean
+func GetEnergySeries(store model.SessionStore, energy model.EnergyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		from, to, step, agg, err := querySeries(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		if _, err := store.GetUserById(id); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		timeRanges, err := getUserTimes(id, store)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		series, err := getEnergySeries(timeRanges, energy, tagsFromQuery(c), from, to, step, agg)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, series)
+	}
+}
+
+// Read the parameters of a series from the request, see GetEnergySeries for their defaults.
+// If one is invalid, the error wraps model.ErrInvalidInput.
+func querySeries(c *gin.Context) (from, to time.Time, step time.Duration, agg string, err error) {
+	to, err = queryTime(c, "to")
+	if err != nil {
+		return
+	}
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+	from, err = queryTime(c, "from")
+	if err != nil {
+		return
+	}
+	if from.IsZero() {
+		from = to.Add(-24 * time.Hour)
+	}
+	if !from.Before(to) {
+		err = fmt.Errorf("%w: from must be before to", model.ErrInvalidInput)
+		return
+	}
+	step, err = parseStep(c.DefaultQuery("step", "1h"))
+	if err != nil || step <= 0 {
+		err = fmt.Errorf("%w: bad step %q, expected a duration like 15m, 1h or 1d", model.ErrInvalidInput, c.Query("step"))
+		return
+	}
+	if to.Sub(from)/step >= maxSeriesWindows {
+		err = fmt.Errorf("%w: more than %d windows, use a larger step", model.ErrInvalidInput, maxSeriesWindows)
+		return
+	}
+	agg = c.DefaultQuery("agg", AggSum)
+	if !slices.Contains(aggregates, agg) {
+		err = fmt.Errorf("%w: unknown aggregate %q, expected one of %v", model.ErrInvalidInput, agg, aggregates)
+	}
+	return
+}
+
+// Gin handler function for the metrics endpoint. Answer the energy points received, in the prometheus text
+// exposition format, for a prometheus scraping this server (see model.Prometheus.WriteMetrics).
+// Access it with .../metrics
+func GetMetrics(metrics model.MetricsWriter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var b bytes.Buffer
+		if err := metrics.WriteMetrics(&b); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", b.Bytes())
+	}
+}
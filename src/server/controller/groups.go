@@ -0,0 +1,214 @@
+package controller
+
+import (
+	"data_api/server/model"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Create a team or a project (kind is "team" or "project"), as a subgroup of parentID if it is not 0. Return its id
+func CreateGroup(store model.SessionStore, name, kind string, parentID int) (int, error) {
+	return store.CreateGroup(name, kind, parentID)
+}
+
+// Add the user to the group
+func AddGroupMember(store model.SessionStore, groupID, userID int) error {
+	return store.AddGroupMember(groupID, userID)
+}
+
+// Remove the user from the group
+func RemoveGroupMember(store model.SessionStore, groupID, userID int) error {
+	return store.RemoveGroupMember(groupID, userID)
+}
+
+// Gin handler function for the api endpoint. Show the list of the groups with their direct members,
+// only the ones of a kind if it is given.
+// Access it with .../groups or .../groups?kind=team
+func GetGroups(store model.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groups, err := store.GetGroups(c.Query("kind"))
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, groups)
+	}
+}
+
+// Gin handler function for the api endpoint. Retrieve a specific group by the id specified in the url.
+// Access it with .../groups/:id
+func GetGroupById(store model.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		group, err := store.GetGroupById(id)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, group)
+	}
+}
+
+// Gin handler function for the api endpoint. Retrieve the ids of all the members of the group, including the ones of its subgroups.
+// Access it with .../groups/:id/members
+func GetGroupMembers(store model.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		members, err := store.GetGroupMembers(id)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, members)
+	}
+}
+
+// Gin handler function for the api endpoint. Same as GetTodayHighlights, for all the members of the group together.
+// A group has no time zone of its own : the periods of the group endpoints start in the one given with tz, else in DEFAULT_TIMEZONE.
+// Access it with .../groups/:id/today or .../groups/:id/today?date=2024-05-01
+func GetGroupTodayHighlights(store model.SessionStore, energy model.EnergyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		filter := tagsFromQuery(c)
+		cal, err := calendarFromQuery(c, store, nil)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		timeRanges, err := store.GetGroupTimes(id)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		day, err := queryDate(c, cal)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		highlights, err := getDayHighlights(cal, day, timeRanges, energy, filter)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, highlights.points())
+	}
+}
+
+// Gin handler function for the api endpoint. Same as GetAllDailyMean, for all the members of the group together,
+// since the first connection of one of them.
+// Access it with .../groups/:id/consumption
+func GetGroupAllDailyMean(store model.SessionStore, energy model.EnergyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		filter := tagsFromQuery(c)
+		cal, err := calendarFromQuery(c, store, nil)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		timeRanges, err := store.GetGroupTimes(id)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		dailyMeans, err := getAllDailyMean(cal, timeRanges, energy, filter)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, dailyMeans)
+	}
+}
+
+// Gin handler function for the api endpoint. Same as GetWeeklyMean, for all the members of the group together.
+// Access it with .../groups/:id/weeklyMean
+func GetGroupWeeklyMean(store model.SessionStore, energy model.EnergyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		filter := tagsFromQuery(c)
+		cal, err := calendarFromQuery(c, store, nil)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		timeRanges, err := store.GetGroupTimes(id)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		weeklyMean, err := getAllWeeklyMeans(cal, timeRanges, energy, filter)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, weeklyMean)
+	}
+}
+
+// Gin handler function for the api endpoint. Retrieve the ranks of the group among the groups of the same kind
+// (a team among the teams, a project among the projects), in the same order as GetRank.
+// Access it with .../groups/:id/rank
+func GetGroupRank(store model.SessionStore, energy model.EnergyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		filter := tagsFromQuery(c)
+		cal, err := calendarFromQuery(c, store, nil)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		ranks, err := RankGroup(id, store, energy, filter, cal)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, ranks)
+	}
+}
+
+// Return the ranks of the group among the groups of its kind, like RankUser does for the users :
+// year, month, week and daily ranks, then the number of groups of this kind.
+// The mean consumption of a group is the one of its time-ranges, each with the shares of all the members connected then
+// added up : it doesn't depend on how many members share a time-range.
+func RankGroup(id int, store model.SessionStore, energy model.EnergyStore, filter model.Tags, cal Calendar) ([]int, error) {
+	group, err := store.GetGroupById(id)
+	if err != nil {
+		return nil, err
+	}
+	allTimeRanges, err := store.GetAllGroupTimes(group.Kind)
+	if err != nil {
+		return nil, err
+	}
+	ids := []int{}
+	for groupID := range allTimeRanges {
+		ids = append(ids, groupID)
+	}
+	slices.Sort(ids)
+	return rank(id, ids, allTimeRanges, energy, filter, cal)
+}
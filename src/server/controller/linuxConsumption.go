@@ -34,6 +34,7 @@ func MonitorEnergy(pointsChan chan model.Point, wg *sync.WaitGroup) {
 	defer wg.Done()
 	prevValue := 0.0
 	var dif float64
+	tags := model.Tags{Host: LocalHost(), Source: "rapl", Domain: "package-0", Unit: "J"}
 
 	for {
 		value, err := readEnergy()
@@ -47,7 +48,7 @@ func MonitorEnergy(pointsChan chan model.Point, wg *sync.WaitGroup) {
 			prevValue = value
 			continue
 		}
-		p := model.Point{Timestamp: time.Now().UTC(), Value: dif * 1e-6}
+		p := model.Point{Timestamp: time.Now().UTC(), Value: dif * 1e-6, Tags: tags}
 		fmt.Println(p)
 		pointsChan <- p
 
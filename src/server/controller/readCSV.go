@@ -14,6 +14,11 @@ import (
 	"time"
 )
 
+// Tags of the points read from a DEMETER csv. The "CPU Energy" row is the total of the machine, so no process is set.
+func demeterTags() model.Tags {
+	return model.Tags{Host: LocalHost(), Source: "demeter", Domain: "cpu", Unit: "mWh"}
+}
+
 // Not verified so may not work, you should use ReadCsvWhileRunning which does the same thing but better.
 func ReadCsv(fileName string) []model.Point {
 
@@ -27,6 +32,7 @@ func ReadCsv(fileName string) []model.Point {
 
 	var points []model.Point
 	var sum float64
+	tags := demeterTags()
 	for {
 		rec, err := reader.Read()
 		if err == io.EOF {
@@ -42,7 +48,7 @@ func ReadCsv(fileName string) []model.Point {
 
 			timestamp, _ := strconv.Atoi(rec[0])
 			t := time.Unix(int64(timestamp), 0).UTC()
-			points = append(points, model.Point{Timestamp: t, Value: sum})
+			points = append(points, model.Point{Timestamp: t, Value: sum, Tags: tags})
 			sum = 0
 		}
 
@@ -94,6 +100,7 @@ func ReadCsvWhileRunning(csvFileName string, pointsChan chan model.Point, wg *sy
 	}
 
 	var sum float64
+	tags := demeterTags()
 
 	for running {
 		rec, err := reader.Read()
@@ -127,7 +134,7 @@ func ReadCsvWhileRunning(csvFileName string, pointsChan chan model.Point, wg *sy
 
 				timestamp, _ := strconv.Atoi(rec[0])
 				t := time.Unix(int64(timestamp), 0).UTC()
-				p, err := json.MarshalIndent(model.Point{Timestamp: t, Value: sum}, "", "\t")
+				p, err := json.MarshalIndent(model.Point{Timestamp: t, Value: sum, Tags: tags}, "", "\t")
 				if err != nil {
 					log.Fatal(err)
 				}
@@ -135,7 +142,7 @@ func ReadCsvWhileRunning(csvFileName string, pointsChan chan model.Point, wg *sy
 					exportFile.Write(p)
 					exportFile.Write([]byte{',', '\n'})
 				}
-				pointsChan <- model.Point{Timestamp: t, Value: sum}
+				pointsChan <- model.Point{Timestamp: t, Value: sum, Tags: tags}
 				sum = 0
 			}
 		}
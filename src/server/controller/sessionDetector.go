@@ -0,0 +1,248 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"data_api/server/model"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A login found in the login records of the machine, by ParseUtmp or ParseSystemdSession.
+type Login struct {
+	Key      string // Identifies the login as long as it lasts
+	Username string
+	TTY      string // pts/0, tty1... empty if the login has none
+	Info     model.SessionInfo
+}
+
+// Layout of a record of utmp on linux (glibc, 64 bits included), 384 bytes in the byte order of the machine.
+type utmpRecord struct {
+	Type    int16
+	_       [2]byte
+	Pid     int32
+	Line    [32]byte
+	ID      [4]byte
+	User    [32]byte
+	Host    [256]byte
+	Exit    [2]int16
+	Session int32
+	Sec     int32
+	Usec    int32
+	Addr    [4]uint32
+	_       [20]byte
+}
+
+const utmpUserProcess = 7 // Type of the records of the users logged in (USER_PROCESS)
+
+// Return the string stored in a fixed size field of utmp, which ends at the first zero byte.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// Return the logins of the users in the utmp records read from r (/var/run/utmp on linux).
+// The records of the processes that ended, of the boot and so on are skipped.
+func ParseUtmp(r io.Reader) ([]Login, error) {
+	logins := []Login{}
+	for {
+		var rec utmpRecord
+		err := binary.Read(r, binary.NativeEndian, &rec)
+		if errors.Is(err, io.EOF) {
+			return logins, nil
+		}
+		if err != nil {
+			return logins, fmt.Errorf("bad utmp record: %w", err)
+		}
+		username := cString(rec.User[:])
+		if rec.Type != utmpUserProcess || username == "" {
+			continue
+		}
+		login := Login{
+			Key:      fmt.Sprintf("utmp:%s:%d", cString(rec.Line[:]), rec.Pid),
+			Username: username,
+			TTY:      cString(rec.Line[:]),
+			Info:     model.SessionInfo{SourceIP: cString(rec.Host[:]), ClientType: "tty"},
+		}
+		// The address is given in network order, ipv4 addresses only use the first word
+		if rec.Addr != [4]uint32{} {
+			ip := make(net.IP, 16)
+			binary.NativeEndian.PutUint32(ip[0:], rec.Addr[0])
+			binary.NativeEndian.PutUint32(ip[4:], rec.Addr[1])
+			binary.NativeEndian.PutUint32(ip[8:], rec.Addr[2])
+			binary.NativeEndian.PutUint32(ip[12:], rec.Addr[3])
+			if rec.Addr[1] == 0 && rec.Addr[2] == 0 && rec.Addr[3] == 0 {
+				ip = ip[:4]
+			}
+			login.Info.SourceIP = ip.String()
+		}
+		if login.Info.SourceIP != "" {
+			login.Info.ClientType = "ssh"
+		}
+		logins = append(logins, login)
+	}
+}
+
+// Return the login described by a session file of systemd-logind read from r (/run/systemd/sessions/<id>, made of
+// KEY=value lines). ok is false if it is not the session of a user (greeter, background...) or if it is closing.
+func ParseSystemdSession(id string, r io.Reader) (login Login, ok bool, err error) {
+	fields := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if found {
+			fields[key] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return login, false, err
+	}
+	if fields["CLASS"] != "user" || fields["STATE"] == "closing" {
+		return login, false, nil
+	}
+	username := fields["USER"]
+	if username == "" && fields["UID"] != "" { // Older versions of systemd only give the uid
+		u, err := user.LookupId(fields["UID"])
+		if err != nil {
+			return login, false, err
+		}
+		username = u.Username
+	}
+	if username == "" {
+		return login, false, fmt.Errorf("systemd session %s has no user", id)
+	}
+	clientType := fields["SERVICE"]
+	if clientType == "" {
+		clientType = fields["TYPE"]
+	}
+	return Login{
+		Key:      "systemd:" + id,
+		Username: username,
+		TTY:      fields["TTY"],
+		Info:     model.SessionInfo{SourceIP: fields["REMOTE_HOST"], ClientType: clientType},
+	}, true, nil
+}
+
+// Return the logins found in the utmp file and in the directory of the systemd sessions (each ignored if its path is empty).
+// A systemd session on the same terminal as a utmp record of the same user is the same login, it is kept once.
+func ReadLogins(utmpPath, systemdDir string) ([]Login, error) {
+	logins := []Login{}
+	if utmpPath != "" {
+		f, err := os.Open(utmpPath)
+		if err != nil {
+			return nil, err
+		}
+		logins, err = ParseUtmp(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if systemdDir == "" {
+		return logins, nil
+	}
+	seen := map[string]bool{}
+	for _, l := range logins {
+		seen[l.Username+" "+l.TTY] = true
+	}
+	entries, err := os.ReadDir(systemdDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		// logind writes the files under a temporary name first, and keeps a FIFO <id>.ref next to each of them :
+		// opening it would block
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") || strings.HasSuffix(entry.Name(), ".ref") {
+			continue
+		}
+		f, err := os.Open(filepath.Join(systemdDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		login, ok, err := ParseSystemdSession(entry.Name(), f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if ok && (login.TTY == "" || !seen[login.Username+" "+login.TTY]) {
+			logins = append(logins, login)
+		}
+	}
+	return logins, nil
+}
+
+// Keeps the sessions of the store in line with the logins of the machine : a session is opened for each new login,
+// for the user known by its unix username, and closed when the login disappears.
+type SessionDetector struct {
+	store model.SessionStore
+	open  map[string]int // Id of the session opened for each login, by key
+}
+
+func NewSessionDetector(store model.SessionStore) *SessionDetector {
+	return &SessionDetector{store: store, open: map[string]int{}}
+}
+
+// Open a session for each login that is not known yet, and close the sessions of the logins that are gone.
+// If a change fails, it is tried again on the next call.
+func (d *SessionDetector) Sync(logins []Login) error {
+	var errs []error
+	current := map[string]bool{}
+	for _, login := range logins {
+		current[login.Key] = true
+		if _, ok := d.open[login.Key]; ok {
+			continue
+		}
+		session, err := d.store.OpenExternalSession(model.Identity{Kind: model.IdentityUsername, Value: login.Username},
+			withLocalHost(login.Info), time.Time{}, "session-detector", "")
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		d.open[login.Key] = session.ID
+	}
+	for key, sessionID := range d.open {
+		if current[key] {
+			continue
+		}
+		if err := d.store.CloseSession(sessionID, "session-detector"); err != nil && !errors.Is(err, model.ErrNotFound) {
+			errs = append(errs, err)
+			continue
+		}
+		delete(d.open, key)
+	}
+	return errors.Join(errs...)
+}
+
+// Read the logins every interval and update the sessions accordingly, until ctx is cancelled.
+// The sessions still open then are closed by the next StartServer.
+func RunSessionDetector(ctx context.Context, store model.SessionStore, utmpPath, systemdDir string, interval time.Duration) {
+	detector := NewSessionDetector(store)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		logins, err := ReadLogins(utmpPath, systemdDir)
+		if err != nil {
+			log.Println("Session detector error:", err)
+		} else if err := detector.Sync(logins); err != nil {
+			log.Println("Session detector error:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"data_api/server/model"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testdata/utmp holds 384-byte records in little endian (amd64, arm64) : a boot, a getty waiting (LOGIN_PROCESS),
+// alice on pts/0 from 192.0.2.10, bob on tty1, carol's ended login (DEAD_PROCESS) and dave from 2001:db8::5.
+func TestParseUtmp(t *testing.T) {
+	f, err := os.Open("testdata/utmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	logins, err := ParseUtmp(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Login{
+		{Key: "utmp:pts/0:1024", Username: "alice", TTY: "pts/0", Info: model.SessionInfo{SourceIP: "192.0.2.10", ClientType: "ssh"}},
+		{Key: "utmp:tty1:1100", Username: "bob", TTY: "tty1", Info: model.SessionInfo{ClientType: "tty"}},
+		{Key: "utmp:pts/2:1300", Username: "dave", TTY: "pts/2", Info: model.SessionInfo{SourceIP: "2001:db8::5", ClientType: "ssh"}},
+	}
+	if !reflect.DeepEqual(logins, want) {
+		t.Errorf("got %+v\nwant %+v", logins, want)
+	}
+}
+
+func TestParseUtmpTruncated(t *testing.T) {
+	data, err := os.ReadFile("testdata/utmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first three records are read, the fourth is cut
+	logins, err := ParseUtmp(strings.NewReader(string(data[:3*384+100])))
+	if err == nil {
+		t.Fatal("no error for a truncated record")
+	}
+	if len(logins) != 1 || logins[0].Username != "alice" {
+		t.Errorf("got %+v before the error, want alice's login", logins)
+	}
+}
+
+func TestParseSystemdSession(t *testing.T) {
+	cases := []struct {
+		file   string
+		wantOK bool
+		want   Login
+	}{
+		{"3", true, Login{Key: "systemd:3", Username: "alice", Info: model.SessionInfo{SourceIP: "192.0.2.10", ClientType: "sshd"}}},
+		{"4", true, Login{Key: "systemd:4", Username: "bob", TTY: "tty1", Info: model.SessionInfo{ClientType: "login"}}},
+		{"c1", false, Login{}}, // greeter
+		{"5", false, Login{}},  // closing
+	}
+	for _, tc := range cases {
+		t.Run(tc.file, func(t *testing.T) {
+			f, err := os.Open("testdata/systemd/" + tc.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			login, ok, err := ParseSystemdSession(tc.file, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tc.wantOK || login != tc.want {
+				t.Errorf("got %+v (ok %t), want %+v (ok %t)", login, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseSystemdSessionWithoutUser(t *testing.T) {
+	if _, ok, err := ParseSystemdSession("7", strings.NewReader("CLASS=user\nSTATE=active\n")); ok || err == nil {
+		t.Errorf("ok %t and error %v for a session without user, want an error", ok, err)
+	}
+}
+
+// bob's systemd session is on the same terminal as his utmp record, it is kept once. alice's has no terminal,
+// it is kept along with her utmp record. The file logind is still writing (.#6abc) is skipped.
+func TestReadLogins(t *testing.T) {
+	logins, err := ReadLogins("testdata/utmp", "testdata/systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, l := range logins {
+		keys = append(keys, l.Key)
+	}
+	want := []string{"utmp:pts/0:1024", "utmp:tty1:1100", "utmp:pts/2:1300", "systemd:3"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("got %v, want %v", keys, want)
+	}
+}
+
+// A SessionStore recording the sessions opened and closed by the detector. The other methods are not used.
+type detectorStore struct {
+	model.SessionStore
+	nextID  int
+	opened  []string // Usernames
+	closed  []int    // Session ids
+	failFor string   // Username whose sessions can't be opened
+	gone    int      // Session whose closing answers ErrNotFound
+}
+
+func (s *detectorStore) OpenExternalSession(identity model.Identity, info model.SessionInfo, at time.Time, actor, requestKey string) (model.Session, error) {
+	if identity.Value == s.failFor {
+		return model.Session{}, errors.New("database down")
+	}
+	s.nextID++
+	s.opened = append(s.opened, identity.Value)
+	return model.Session{ID: s.nextID}, nil
+}
+
+func (s *detectorStore) CloseSession(sessionID int, actor string) error {
+	if sessionID == s.gone {
+		return model.ErrNotFound
+	}
+	s.closed = append(s.closed, sessionID)
+	return nil
+}
+
+func TestSessionDetectorSync(t *testing.T) {
+	login := func(key, username string) Login { return Login{Key: key, Username: username} }
+	alice, bob, carol := login("utmp:pts/0:1", "alice"), login("utmp:pts/1:2", "bob"), login("systemd:3", "carol")
+
+	store := &detectorStore{gone: 2}
+	d := NewSessionDetector(store)
+	steps := []struct {
+		name    string
+		logins  []Login
+		failFor string
+		wantErr bool
+		opened  []string
+		closed  []int
+		open    map[string]int
+	}{
+		{"first logins", []Login{alice, bob}, "", false, []string{"alice", "bob"}, nil,
+			map[string]int{alice.Key: 1, bob.Key: 2}},
+		{"nothing changed", []Login{bob, alice}, "", false, []string{"alice", "bob"}, nil,
+			map[string]int{alice.Key: 1, bob.Key: 2}},
+		{"alice left, carol can't be opened", []Login{bob, carol}, "carol", true, []string{"alice", "bob"}, []int{1},
+			map[string]int{bob.Key: 2}},
+		{"carol opened on retry, bob's session already closed", []Login{carol}, "", false, []string{"alice", "bob", "carol"}, []int{1},
+			map[string]int{carol.Key: 3}},
+		{"everyone left", nil, "", false, []string{"alice", "bob", "carol"}, []int{1, 3}, map[string]int{}},
+	}
+	for _, step := range steps {
+		store.failFor = step.failFor
+		err := d.Sync(step.logins)
+		if (err != nil) != step.wantErr {
+			t.Fatalf("%s: error %v, want one %t", step.name, err, step.wantErr)
+		}
+		if !reflect.DeepEqual(store.opened, step.opened) || !reflect.DeepEqual(store.closed, step.closed) {
+			t.Errorf("%s: opened %v and closed %v, want %v and %v", step.name, store.opened, store.closed, step.opened, step.closed)
+		}
+		if !reflect.DeepEqual(d.open, step.open) {
+			t.Errorf("%s: open %v, want %v", step.name, d.open, step.open)
+		}
+	}
+}
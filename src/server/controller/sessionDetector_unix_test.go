@@ -0,0 +1,45 @@
+//go:build unix
+
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The FIFO logind keeps next to each session file is skipped : reading it would block until a writer comes.
+func TestReadLoginsSkipsFIFO(t *testing.T) {
+	dir := t.TempDir()
+	data, err := os.ReadFile("testdata/systemd/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "3"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"3.ref", "4"} { // 4 : a FIFO without the .ref suffix is skipped too
+		if err := syscall.Mkfifo(filepath.Join(dir, name), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan []Login)
+	go func() {
+		logins, err := ReadLogins("", dir)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- logins
+	}()
+	select {
+	case logins := <-done:
+		if len(logins) != 1 || logins[0].Key != "systemd:3" {
+			t.Errorf("got %+v, want the login of the session 3", logins)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadLogins blocked on a FIFO")
+	}
+}
@@ -0,0 +1,173 @@
+package controller
+
+import (
+	"context"
+	"data_api/server/model"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Gin handler function for the api endpoint. Retrieve all the sessions of the user, the most recent first,
+// with their energy (once computed), duration and average power.
+// Access it with .../users/:id/sessions
+func GetUserSessions(store model.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		if _, err := store.GetUserById(id); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		sessions, err := store.GetUserSessions(id)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, sessions)
+	}
+}
+
+// Gin handler function for the write endpoint. The clients call it periodically to tell that the user is still there.
+// It counts for all the open sessions of the user, see SessionHeartbeat to keep alive a single one.
+// Once a client sent one, the session is closed if it stops for longer than the idle timeout (see RunIdleReaper).
+// Access it with POST .../users/:id/heartbeat
+func UserHeartbeat(store model.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		if err := store.UserHeartbeat(id); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// Gin handler function for the write endpoint. Same as UserHeartbeat, for the session specified by the id in the url only.
+// Access it with POST .../sessions/:id/heartbeat
+func SessionHeartbeat(store model.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		if err := store.SessionHeartbeat(id); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// Close every interval the sessions whose client sent no heartbeat for longer than timeout, until ctx is cancelled.
+// They are closed at their last heartbeat, so they are not charged for the time they were gone.
+func RunIdleReaper(ctx context.Context, store model.SessionStore, timeout, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ids, err := store.DisconnectIdleSessions(timeout, "idle-reaper")
+		if err != nil {
+			log.Println("Idle reaper error:", err)
+		}
+		if len(ids) > 0 {
+			log.Printf("Closed the idle sessions %v\n", ids)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Compute the energy attributed to the session : the share of the user in the consumption of the session host
+// during each of its time-ranges. If the host has points in several units, the unit with the most points is kept.
+// The sessions rebuilt from the links of older versions have no host, they use this server like the endpoints.
+func computeSessionEnergy(session model.Session, store model.SessionStore, energy model.EnergyStore) (float64, string, error) {
+	timeRanges, err := store.GetSessionTimes(session.ID)
+	if err != nil {
+		return 0, "", err
+	}
+	points, err := getEnergyConsumption(timeRanges, energy, model.Tags{Host: withLocalHost(session.SessionInfo).Host})
+	if err != nil {
+		return 0, "", err
+	}
+	sums := map[string]float64{}
+	counts := map[string]int{}
+	unit := ""
+	for _, p := range points {
+		sums[p.Tags.Unit] += p.Value
+		counts[p.Tags.Unit] += p.Weight()
+		if counts[p.Tags.Unit] > counts[unit] {
+			unit = p.Tags.Unit
+		}
+	}
+	return sums[unit], unit, nil
+}
+
+// Compute the energy of the sessions closed since the last run, every interval, until ctx is cancelled.
+// A session whose energy can't be computed (energy database unavailable...) is tried again on the next run.
+func RunSessionEnergy(ctx context.Context, store model.SessionStore, energy model.EnergyStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		sessions, err := store.GetSessionsToCompute(100)
+		if err != nil {
+			log.Println("Session energy error:", err)
+		}
+		for _, session := range sessions {
+			value, unit, err := computeSessionEnergy(session, store, energy)
+			if err != nil {
+				log.Printf("Session energy error on session %d: %v\n", session.ID, err)
+				break
+			}
+			if err := store.SetSessionEnergy(session.ID, value, unit); err != nil {
+				log.Printf("Session energy error on session %d: %v\n", session.ID, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Gin handler function for the api endpoint. Retrieve the session events (connections and disconnections) recorded
+// after the event with the id after (0 by default), in the order they were recorded, at most limit (1000 by default).
+// Calling it again with the last id received follows the stream of the events.
+// Access it with .../events?after=120&limit=500
+func GetSessionEvents(store model.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		after, err := strconv.Atoi(c.DefaultQuery("after", "0"))
+		if err != nil || after < 0 {
+			abortWithError(c, fmt.Errorf("%w: bad event id %q", model.ErrInvalidInput, c.Query("after")))
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "1000"))
+		if err != nil || limit < 1 {
+			abortWithError(c, fmt.Errorf("%w: bad limit %q", model.ErrInvalidInput, c.Query("limit")))
+			return
+		}
+		events, err := store.GetSessionEvents(after, limit)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusOK, events)
+	}
+}
@@ -0,0 +1,147 @@
+package controller
+
+import (
+	"data_api/server/model"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Header carrying the key chosen by the client for a write request. A request sent again with the same key
+// (after a timeout...) is not done twice : the answer is the one of the first request.
+const requestKeyHeader = "Idempotency-Key"
+
+// Body of the POST /sessions requests. The user is given either by its id or by an external identity.
+type openSessionRequest struct {
+	UserID     *int            `json:"userID"`
+	Identity   *model.Identity `json:"identity"`
+	Host       string          `json:"host"`
+	SourceIP   string          `json:"sourceIP"`
+	ClientType string          `json:"clientType"`
+	At         time.Time       `json:"at"` // When the session opened (RFC 3339), now if it is absent
+}
+
+// Body of the POST /users requests.
+type createUserRequest struct {
+	DisplayName string            `json:"displayName"`
+	Team        string            `json:"team"`
+	Labels      map[string]string `json:"labels"`
+	Identities  []model.Identity  `json:"identities"`
+}
+
+// Body of the PUT /users/:id/timezone requests.
+type timezoneRequest struct {
+	Timezone string `json:"timezone"` // IANA name like Europe/Paris, empty for the time zone of the server
+}
+
+// Open a session at the time at (now if it is the zero time) for the user with this id, or for the user known
+// by identity if it is not nil. See model.OpenSession for requestKey.
+func OpenSession(store model.SessionStore, id int, identity *model.Identity, info model.SessionInfo, at time.Time, actor, requestKey string) (model.Session, error) {
+	if identity != nil {
+		return store.OpenExternalSession(*identity, withLocalHost(info), at, actor, requestKey)
+	}
+	return store.OpenSession(id, withLocalHost(info), at, actor, requestKey)
+}
+
+// Create a user without connecting it, see model.CreateUser.
+func CreateUser(store model.SessionStore, displayName, team string, labels map[string]string, identities []model.Identity, actor, requestKey string) (model.User, error) {
+	return store.CreateUser(displayName, team, labels, identities, actor, requestKey)
+}
+
+// Gin handler function for the write endpoint. Open a session for the user given in the json body, by id or by identity
+// (the user is created if nobody has it yet), and answer with the session. Send the header Idempotency-Key to retry safely.
+// A remote agent sending it late gives the time the session opened in "at".
+// Access it with POST .../sessions {"userID": 12, "host": "node1", "sourceIP": "10.0.0.3", "clientType": "ssh"}
+// or {"identity": {"kind": "username", "value": "alice"}, "clientType": "jupyter", "at": "2024-05-01T08:00:00Z"}
+func OpenSessionHandler(store model.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req openSessionRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abortWithError(c, fmt.Errorf("%w: %v", model.ErrInvalidInput, err))
+			return
+		}
+		if (req.UserID == nil) == (req.Identity == nil) {
+			abortWithError(c, fmt.Errorf("%w: give either userID or identity", model.ErrInvalidInput))
+			return
+		}
+		id := 0
+		if req.UserID != nil {
+			id = *req.UserID
+		}
+		info := model.SessionInfo{Host: req.Host, SourceIP: req.SourceIP, ClientType: req.ClientType}
+		session, err := OpenSession(store, id, req.Identity, info, req.At, requestActor(c), c.GetHeader(requestKeyHeader))
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusCreated, session)
+	}
+}
+
+// Gin handler function for the write endpoint. Close the session specified by the id in the url,
+// the other sessions of its user stay open. Closing a session already closed does nothing.
+// The optional parameter at (RFC 3339) is the time it closed, for the disconnections sent late.
+// Access it with DELETE .../sessions/:id or DELETE .../sessions/:id?at=2024-05-01T18:00:00Z
+func CloseSessionHandler(store model.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		at, err := queryTime(c, "at")
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		if err := CloseSessionAt(store, id, at, requestActor(c)); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// Gin handler function for the write endpoint. Create a user with the profile and identities of the json body,
+// without connecting it, and answer with the user. Send the header Idempotency-Key to retry safely.
+// Access it with POST .../users {"displayName": "Alice", "team": "hpc", "identities": [{"kind": "username", "value": "alice"}]}
+func CreateUserHandler(store model.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req createUserRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abortWithError(c, fmt.Errorf("%w: %v", model.ErrInvalidInput, err))
+			return
+		}
+		user, err := CreateUser(store, req.DisplayName, req.Team, req.Labels, req.Identities, requestActor(c), c.GetHeader(requestKeyHeader))
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.IndentedJSON(http.StatusCreated, user)
+	}
+}
+
+// Gin handler function for the write endpoint. Set the time zone the days, weeks, months and years of the user start in
+// for the consumption endpoints, when they are called without tz.
+// Access it with PUT .../users/:id/timezone {"timezone": "Europe/Paris"}
+func SetUserTimezoneHandler(store model.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := paramID(c)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		var req timezoneRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abortWithError(c, fmt.Errorf("%w: %v", model.ErrInvalidInput, err))
+			return
+		}
+		if err := SetUserTimezone(store, id, req.Timezone); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,121 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The actions recorded in the audit log.
+const (
+	AuditReset             = "reset"               // Every table but the audit log was dropped
+	AuditServerRestart     = "server_restart"      // The sessions left open by the previous run were closed
+	AuditNewUser           = "new_user"            // A user was created and connected
+	AuditCreateUser        = "create_user"         // A user was created, without connecting it
+	AuditConnection        = "connection"          // A user was connected
+	AuditDeconnection      = "deconnection"        // A user was disconnected
+	AuditEraseUser         = "erase_user"          // A user was erased, see EraseUser
+	AuditRebuildTimeRanges = "rebuild_time_ranges" // The time-ranges were derived again from the session events
+)
+
+// Migrations of the audit log, kept applied by Reset since the table isn't dropped.
+var auditMigrations = []int{8, 9, 16, 18}
+
+// An entry of the audit log. Previous and Details are the json given to writeAudit.
+type AuditEntry struct {
+	ID       int             `json:"id"`
+	At       time.Time       `json:"at"`
+	Actor    string          `json:"actor"`
+	Action   string          `json:"action"`
+	UserID   sql.NullInt32   `json:"userID"`
+	Previous json.RawMessage `json:"previous"`
+	Details  json.RawMessage `json:"details"`
+	Redacted bool            `json:"redacted"` // The user was erased since : userID, previous and details were removed
+}
+
+// Add an entry to the audit log inside tx, so that it is only kept if the change it describes is committed.
+// userID is the user the action was done on (0 if none), previous the values changed by the action as they were
+// before it (nil if it only added rows), and details anything else worth keeping. Both are encoded in json.
+// Since the log can't be changed, they only hold ids, times and counts : nothing personal (addresses, identities...).
+func writeAudit(tx *sql.Tx, actor, action string, userID int, previous, details interface{}) error {
+	encoded, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	var encodedPrevious sql.NullString
+	if previous != nil {
+		b, err := json.Marshal(previous)
+		if err != nil {
+			return err
+		}
+		encodedPrevious = sql.NullString{String: string(b), Valid: true}
+	}
+	target := sql.NullInt64{Int64: int64(userID), Valid: userID != 0}
+	_, err = tx.Exec("insert into audit_log (at, actor, action, userID, previous, details) values ($1, $2, $3, $4, $5, $6)",
+		time.Now().UTC(), actor, action, target, encodedPrevious, string(encoded))
+	return err
+}
+
+// Redact the entries of the audit log about the user inside tx, when it is erased : they keep their time, actor
+// and action, but no longer tell who they were about nor what was stored about the user (the address of its sessions...).
+// It is the only change the append-only triggers let through. Return the number of entries redacted.
+func redactAudit(tx *sql.Tx, userID int) (int64, error) {
+	res, err := tx.Exec("update audit_log set userID = null, previous = null, details = '{}', redacted = $1 where userID = $2", true, userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Return the entries of the audit log about the user (all of them if userID is 0) between from and to
+// (no bound if zero), the most recent first, at most limit of them.
+func (s *SQLStore) GetAuditLog(userID int, from, to time.Time, limit int) ([]AuditEntry, error) {
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return nil, invalidInput("the end of the window (%s) is before its start (%s)", to.Format(time.RFC3339), from.Format(time.RFC3339))
+	}
+	var where []string
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if userID != 0 {
+		where = append(where, "userID = "+arg(userID))
+	}
+	at := fmt.Sprintf(s.dialect.orderedTime, "at")
+	if !from.IsZero() {
+		where = append(where, at+" >= "+fmt.Sprintf(s.dialect.orderedTime, arg(from.UTC())))
+	}
+	if !to.IsZero() {
+		where = append(where, at+" <= "+fmt.Sprintf(s.dialect.orderedTime, arg(to.UTC())))
+	}
+	query := "select id, at, actor, action, userID, previous, details, redacted from audit_log"
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+	rows, err := s.db.Query(query+" order by id desc limit "+arg(limit), args...)
+	if err != nil {
+		return nil, unavailable("get audit log", err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var previous sql.NullString
+		var details string
+		if err := rows.Scan(&e.ID, &e.At, &e.Actor, &e.Action, &e.UserID, &previous, &details, &e.Redacted); err != nil {
+			return nil, unavailable("get audit log", err)
+		}
+		e.Details = json.RawMessage(details)
+		if previous.Valid {
+			e.Previous = json.RawMessage(previous.String)
+		} else {
+			e.Previous = json.RawMessage("null")
+		}
+		entries = append(entries, e)
+	}
+	return entries, unavailable("get audit log", rows.Err())
+}
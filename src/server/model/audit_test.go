@@ -0,0 +1,59 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The window and the limit are applied by the database. The entries are a second apart with fractions of seconds,
+// which sqlite doesn't order as text.
+func TestGetAuditLog(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, s *SQLStore) {
+		migrated(t, s)
+		t0 := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		for i, at := range []time.Duration{0, 500 * time.Millisecond, time.Second, 2*time.Second + 250*time.Millisecond} {
+			if _, err := s.db.Exec("insert into audit_log (at, actor, action, userID, details) values ($1, $2, $3, $4, $5)",
+				t0.Add(at), "test", AuditConnection, 1+i%2, "{}"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cases := []struct {
+			name     string
+			userID   int
+			from, to time.Duration // From t0, no bound if negative
+			limit    int
+			want     []int // Ids
+		}{
+			{"everything", 0, -1, -1, 10, []int{4, 3, 2, 1}},
+			{"limit", 0, -1, -1, 2, []int{4, 3}},
+			{"window", 0, 500 * time.Millisecond, time.Second, 10, []int{3, 2}},
+			{"from", 0, time.Second, -1, 10, []int{4, 3}},
+			{"to", 0, -1, 600 * time.Millisecond, 10, []int{2, 1}},
+			{"user", 1, 0, 2 * time.Second, 10, []int{3, 1}},
+			{"user and limit", 2, -1, -1, 1, []int{4}},
+		}
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				var from, to time.Time
+				if tc.from >= 0 {
+					from = t0.Add(tc.from)
+				}
+				if tc.to >= 0 {
+					to = t0.Add(tc.to)
+				}
+				entries, err := s.GetAuditLog(tc.userID, from, to, tc.limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids := []int{}
+				for _, e := range entries {
+					ids = append(ids, e.ID)
+				}
+				if !reflect.DeepEqual(ids, tc.want) {
+					t.Errorf("entries %v, want %v", ids, tc.want)
+				}
+			})
+		}
+	})
+}
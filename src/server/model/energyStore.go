@@ -0,0 +1,31 @@
+package model
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// EnergyStore is the time-series database that keeps the energy points. The controller only uses this interface,
+// so that the points can be stored either in influx (Influx) or in a prometheus compatible database (Prometheus).
+type EnergyStore interface {
+	PopulateDBFromPoints(data []Point)
+	PopulateDBFromChan(pointsChan chan Point, wg *sync.WaitGroup)
+	PopulateFakeDB()
+	GetData(start, stop time.Time, resolution time.Duration, filter Tags) ([]Point, error)
+	GetTodayHighlights(filter Tags) ([]Point, error)
+	GetWeeklyMean(filter Tags) ([]Point, error)
+	Close()
+}
+
+// MetricsWriter is implemented by the energy stores whose points can also be scraped by a prometheus :
+// WriteMetrics writes them in the text exposition format.
+type MetricsWriter interface {
+	WriteMetrics(w io.Writer) error
+}
+
+var (
+	_ EnergyStore   = (*Influx)(nil)
+	_ EnergyStore   = (*Prometheus)(nil)
+	_ MetricsWriter = (*Prometheus)(nil)
+)
@@ -0,0 +1,220 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"time"
+)
+
+// The ways to honour a request to erase a user, see EraseUser.
+const (
+	EraseDelete       = "delete"       // Remove the user and everything tied to it
+	ErasePseudonymise = "pseudonymise" // Keep the links and sessions for the statistics, under a new id tied to nothing
+	EraseExport       = "export"       // Return everything known about the user, then remove it like EraseDelete
+)
+
+var eraseModes = []string{EraseDelete, ErasePseudonymise, EraseExport}
+
+// Everything stored about a user, as returned by the export mode of EraseUser.
+type UserExport struct {
+	User     User           `json:"user"`
+	Groups   []int          `json:"groups"`
+	Links    []Link         `json:"links"`
+	Sessions []Session      `json:"sessions"`
+	Events   []SessionEvent `json:"events"`
+}
+
+// What EraseUser did.
+type ErasureReport struct {
+	UserID      int              `json:"userID"`
+	Mode        string           `json:"mode"`
+	At          time.Time        `json:"at"`
+	PseudonymID int              `json:"pseudonymID,omitempty"` // New id of the links and sessions in pseudonymise mode, only told to the caller
+	Rows        map[string]int64 `json:"rows"`                  // Number of rows removed (or moved to the pseudonym, or redacted) by table
+	Export      *UserExport      `json:"export,omitempty"`
+}
+
+// Erase the user with this id according to mode (EraseDelete, ErasePseudonymise or EraseExport).
+// The user is disconnected first if needed. Everything is done in a single transaction, along with the redaction
+// of the entries of the audit log about the user (see redactAudit) and a new one recording the actor, the reason
+// and what was done (but nothing about the erased user besides its old id, not even its pseudonym).
+//
+// The time-ranges are never changed : they only count users, so the shares of the other users stay the same.
+// In delete and export modes the session events of the user go too, so the time-ranges derived again later
+// over the same period (for an event sent late, or by RebuildTimeRanges) no longer count them.
+// In pseudonymise mode, the links and sessions (without their source address) are moved to a new user
+// that has no identity, name, team, label or group, so the consumption statistics are kept.
+func (s *SQLStore) EraseUser(id int, mode, actor, reason string) (ErasureReport, error) {
+	report := ErasureReport{UserID: id, Mode: mode}
+	if !slices.Contains(eraseModes, mode) {
+		return report, invalidInput("unknown erasure mode %q, expected one of %v", mode, eraseModes)
+	}
+	if actor == "" {
+		return report, invalidInput("the actor of an erasure must be given")
+	}
+
+	err := s.withTx(func(tx *sql.Tx) error {
+		report.Rows = map[string]int64{}
+		report.PseudonymID = 0
+		report.Export = nil
+		report.At = time.Now().UTC()
+
+		var exists int
+		if err := tx.QueryRow("select count(*) from users where id = $1", id).Scan(&exists); err != nil {
+			return err
+		}
+		if exists == 0 {
+			return notFound("no user with id %d", id)
+		}
+		if err := s.userDeconnection(tx, id, actor); err != nil {
+			return err
+		}
+
+		if mode == EraseExport {
+			export, err := exportUser(tx, id)
+			if err != nil {
+				return err
+			}
+			report.Export = &export
+		}
+
+		exec := func(table, query string, args ...interface{}) error {
+			res, err := tx.Exec(query, args...)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			report.Rows[table] += n
+			return err
+		}
+		if mode == ErasePseudonymise {
+			if err := tx.QueryRow(`insert into users (start_session, end_session)
+				select start_session, end_session from users where id = $1 returning id`, id).Scan(&report.PseudonymID); err != nil {
+				return err
+			}
+			if err := exec("link", "update link set userID = $1 where userID = $2", report.PseudonymID, id); err != nil {
+				return err
+			}
+			if err := exec("sessions", "update sessions set userID = $1, source_ip = '' where userID = $2", report.PseudonymID, id); err != nil {
+				return err
+			}
+		} else {
+			if err := exec("link", "delete from link where userID = $1", id); err != nil {
+				return err
+			}
+			if err := exec("session_events", "delete from session_events where sessionID in (select id from sessions where userID = $1)", id); err != nil {
+				return err
+			}
+			if err := exec("sessions", "delete from sessions where userID = $1", id); err != nil {
+				return err
+			}
+		}
+		if err := exec("group_members", "delete from group_members where userID = $1", id); err != nil {
+			return err
+		}
+		if err := exec("identities", "delete from identities where userID = $1", id); err != nil {
+			return err
+		}
+		if err := exec("users", "delete from users where id = $1", id); err != nil {
+			return err
+		}
+		redacted, err := redactAudit(tx, id)
+		if err != nil {
+			return err
+		}
+		report.Rows["audit_log"] = redacted
+
+		// The pseudonym isn't recorded, nothing must tie it back to the user
+		return writeAudit(tx, actor, AuditEraseUser, id, nil, map[string]interface{}{
+			"mode": mode, "reason": reason, "rows": report.Rows,
+		})
+	})
+	return report, unavailable("erase user", err)
+}
+
+// Read everything stored about the user inside tx, before it is erased.
+func exportUser(tx *sql.Tx, id int) (UserExport, error) {
+	export := UserExport{Groups: []int{}, Links: []Link{}, Sessions: []Session{}, Events: []SessionEvent{}}
+
+	user, err := scanUser(tx.QueryRow("select "+userColumns+" from users where id = $1", id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return export, notFound("no user with id %d", id)
+		}
+		return export, err
+	}
+	export.User = user
+
+	rows, err := tx.Query("select kind, value from identities where userID = $1 order by id", id)
+	if err != nil {
+		return export, err
+	}
+	for rows.Next() {
+		var i Identity
+		if err := rows.Scan(&i.Kind, &i.Value); err != nil {
+			rows.Close()
+			return export, err
+		}
+		export.User.Identities = append(export.User.Identities, i)
+	}
+	rows.Close()
+
+	rows, err = tx.Query("select groupID from group_members where userID = $1 order by groupID", id)
+	if err != nil {
+		return export, err
+	}
+	for rows.Next() {
+		var groupID int
+		if err := rows.Scan(&groupID); err != nil {
+			rows.Close()
+			return export, err
+		}
+		export.Groups = append(export.Groups, groupID)
+	}
+	rows.Close()
+
+	rows, err = tx.Query("select "+linkColumns+" from link where userID = $1 order by id", id)
+	if err != nil {
+		return export, err
+	}
+	for rows.Next() {
+		l, err := scanLink(rows)
+		if err != nil {
+			rows.Close()
+			return export, err
+		}
+		export.Links = append(export.Links, l)
+	}
+	rows.Close()
+	setOverlaps(export.Links)
+
+	rows, err = tx.Query("select "+sessionColumns+" from sessions where userID = $1 order by id", id)
+	if err != nil {
+		return export, err
+	}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			rows.Close()
+			return export, err
+		}
+		export.Sessions = append(export.Sessions, session)
+	}
+	rows.Close()
+
+	rows, err = tx.Query(`select id, sessionID, kind, at, recorded_at, source from session_events
+		where sessionID in (select id from sessions where userID = $1) order by id`, id)
+	if err != nil {
+		return export, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e SessionEvent
+		if err := rows.Scan(&e.ID, &e.SessionID, &e.Kind, &e.At, &e.RecordedAt, &e.Source); err != nil {
+			return export, err
+		}
+		export.Events = append(export.Events, e)
+	}
+	return export, rows.Err()
+}
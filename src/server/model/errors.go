@@ -0,0 +1,33 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The kinds of errors returned by the model. The functions wrap them with the details of what failed,
+// so the callers (the gin handlers mostly) tell them apart with errors.Is :
+//
+//	if errors.Is(err, model.ErrNotFound) { ... }
+var (
+	ErrNotFound     = errors.New("not found")           // The user, time-range... asked for doesn't exist
+	ErrInvalidInput = errors.New("invalid input")       // The arguments can't be used (negative id, bad tag key...)
+	ErrUnavailable  = errors.New("storage unavailable") // A database couldn't be reached or failed to answer
+)
+
+// Return err (an error of a database driver or client) wrapped as ErrUnavailable, with what was being done.
+// The errors that already have a kind are returned as is, and nil stays nil.
+func unavailable(what string, err error) error {
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrInvalidInput) || errors.Is(err, ErrUnavailable) {
+		return err
+	}
+	return fmt.Errorf("%w: %s: %w", ErrUnavailable, what, err)
+}
+
+func notFound(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrNotFound, fmt.Sprintf(format, args...))
+}
+
+func invalidInput(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidInput, fmt.Sprintf(format, args...))
+}
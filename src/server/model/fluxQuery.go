@@ -0,0 +1,177 @@
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Identifiers (tag keys, flux function names) cannot be passed as flux parameters, so they are checked against these
+// patterns before being written into the query. Everything else (bucket, times, tag values...) goes through params.
+var (
+	identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	durationRegexp   = regexp.MustCompile(`^-?([0-9]+(ns|us|ms|s|mo|m|h|d|w|y))+$`)
+)
+
+// Returned by build when the query can't be written safely. It is an ErrInvalidInput.
+var ErrInvalidQuery = fmt.Errorf("%w: invalid flux query", ErrInvalidInput)
+
+// Small builder for flux queries. The values given by the caller are never concatenated into the query string :
+// they are stored in the params map and referenced as params.xxx, which the influx server substitutes itself.
+//
+//	query, params, err := newFluxQuery(bucket, start, stop).measurement("energy").field("energyConsumption").tags(filter).build()
+type fluxQuery struct {
+	lines  []string
+	params map[string]interface{}
+	err    error
+}
+
+// Start a query reading bucket between start and stop.
+func newFluxQuery(bucket string, start, stop time.Time) *fluxQuery {
+	q := &fluxQuery{params: map[string]interface{}{}}
+	if bucket == "" {
+		q.fail("empty bucket name")
+	}
+	q.params["bucket"] = bucket
+	q.params["start"] = start.UTC().Format(time.RFC3339Nano)
+	q.params["stop"] = stop.UTC().Format(time.RFC3339Nano)
+	q.lines = append(q.lines,
+		"from(bucket: params.bucket)",
+		"|> range(start: time(v: params.start), stop: time(v: params.stop))")
+	return q
+}
+
+func (q *fluxQuery) fail(format string, args ...interface{}) {
+	if q.err == nil {
+		q.err = fmt.Errorf("%w: %s", ErrInvalidQuery, fmt.Sprintf(format, args...))
+	}
+}
+
+// Add a parameter and return the expression referencing it.
+func (q *fluxQuery) param(value string) string {
+	name := fmt.Sprintf("p%d", len(q.params))
+	q.params[name] = value
+	return "params." + name
+}
+
+// Keep only the rows of the given measurement.
+func (q *fluxQuery) measurement(name string) *fluxQuery {
+	q.lines = append(q.lines, "|> filter(fn: (r) => r._measurement == "+q.param(name)+")")
+	return q
+}
+
+// Keep only the rows of the given field.
+func (q *fluxQuery) field(name string) *fluxQuery {
+	return q.fields(name)
+}
+
+// Keep only the rows of one of the given fields.
+func (q *fluxQuery) fields(names ...string) *fluxQuery {
+	conditions := []string{}
+	for _, name := range names {
+		conditions = append(conditions, "r._field == "+q.param(name))
+	}
+	q.lines = append(q.lines, "|> filter(fn: (r) => "+strings.Join(conditions, " or ")+")")
+	return q
+}
+
+// Keep only the rows whose tag key equals value.
+func (q *fluxQuery) tag(key, value string) *fluxQuery {
+	if !identifierRegexp.MatchString(key) {
+		q.fail("invalid tag key %q", key)
+		return q
+	}
+	q.lines = append(q.lines, "|> filter(fn: (r) => r."+key+" == "+q.param(value)+")")
+	return q
+}
+
+// Keep only the rows matching the non-empty tags of filter.
+func (q *fluxQuery) tags(filter Tags) *fluxQuery {
+	for _, key := range tagKeys {
+		if v, ok := filter.Map()[key]; ok {
+			q.tag(key, v)
+		}
+	}
+	return q
+}
+
+// Merge all the series into a single table, so that the aggregates are computed over all of them.
+func (q *fluxQuery) group() *fluxQuery {
+	q.lines = append(q.lines, "|> group()")
+	return q
+}
+
+// Apply an aggregate or selector function without arguments, like max, min, sum or mean.
+func (q *fluxQuery) aggregate(fn string) *fluxQuery {
+	if !identifierRegexp.MatchString(fn) {
+		q.fail("invalid function name %q", fn)
+		return q
+	}
+	q.lines = append(q.lines, "|> "+fn+"()")
+	return q
+}
+
+// Aggregate the rows with fn over windows of every (a flux duration like 1w), shifted by offset.
+func (q *fluxQuery) window(every, offset, fn string) *fluxQuery {
+	if !durationRegexp.MatchString(every) || !durationRegexp.MatchString(offset) {
+		q.fail("invalid window %q offset %q", every, offset)
+		return q
+	}
+	if !identifierRegexp.MatchString(fn) {
+		q.fail("invalid function name %q", fn)
+		return q
+	}
+	q.lines = append(q.lines, "|> aggregateWindow(every: "+every+", fn: "+fn+", offset: "+offset+")")
+	return q
+}
+
+// Aggregate each series with fn over windows of every, without empty windows. The rows are timestamped
+// with the start of their window, so that a window belongs to the range that contains its start.
+func (q *fluxQuery) rollupWindow(every time.Duration, fn string) *fluxQuery {
+	if every <= 0 {
+		q.fail("invalid window %s", every)
+		return q
+	}
+	if !identifierRegexp.MatchString(fn) {
+		q.fail("invalid function name %q", fn)
+		return q
+	}
+	q.lines = append(q.lines, fmt.Sprintf(`|> aggregateWindow(every: %ds, fn: %s, createEmpty: false, timeSrc: "_start")`, int64(every/time.Second), fn))
+	return q
+}
+
+// Rename the field of every row.
+func (q *fluxQuery) setField(name string) *fluxQuery {
+	q.lines = append(q.lines, `|> set(key: "_field", value: `+q.param(name)+")")
+	return q
+}
+
+// Write the rows into another bucket of the same organisation.
+func (q *fluxQuery) to(bucket string) *fluxQuery {
+	if bucket == "" {
+		q.fail("empty bucket name")
+	}
+	q.lines = append(q.lines, "|> to(bucket: "+q.param(bucket)+")")
+	return q
+}
+
+// Put the fields of a same series and time on a single row, one column per field.
+func (q *fluxQuery) pivotFields() *fluxQuery {
+	q.lines = append(q.lines, `|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")`)
+	return q
+}
+
+// Keep only the most recent row of all the series.
+func (q *fluxQuery) latest() *fluxQuery {
+	q.lines = append(q.lines, "|> last()", "|> group()", `|> max(column: "_time")`)
+	return q
+}
+
+// Return the flux query and its parameters, or the first validation error met while building it.
+func (q *fluxQuery) build() (string, map[string]interface{}, error) {
+	if q.err != nil {
+		return "", nil, q.err
+	}
+	return strings.Join(q.lines, "\n\t"), q.params, nil
+}
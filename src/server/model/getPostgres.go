@@ -2,23 +2,92 @@ package model
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"time"
 )
 
 type User struct {
-	ID            int          `json:"id"`
-	Start_session time.Time    `json:"start_session"`
-	End_session   sql.NullTime `json:"end_session"`
+	ID            int               `json:"id"`
+	Start_session time.Time         `json:"start_session"`
+	End_session   sql.NullTime      `json:"end_session"`
+	DisplayName   string            `json:"displayName"`
+	Team          string            `json:"team"`
+	Labels        map[string]string `json:"labels"`
+	Identities    []Identity        `json:"identities"`
+	Timezone      string            `json:"timezone"` // Where its days start (IANA name), empty for the time zone of the server
+}
+
+const userColumns = "id, start_session, end_session, display_name, team, labels, timezone"
+
+// A *sql.Row or *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Scan a row of the userColumns into a User, without its identities.
+func scanUser(row rowScanner) (User, error) {
+	var u User
+	var labels string
+	if err := row.Scan(&u.ID, &u.Start_session, &u.End_session, &u.DisplayName, &u.Team, &labels, &u.Timezone); err != nil {
+		return u, err
+	}
+	u.Labels = map[string]string{}
+	if err := json.Unmarshal([]byte(labels), &u.Labels); err != nil {
+		return u, fmt.Errorf("labels of user %d: %w", u.ID, err)
+	}
+	u.Identities = []Identity{}
+	return u, nil
 }
 
 type TimeRange struct {
-	ID       int          `json:"id"`
-	Start    time.Time    `json:"start"`
-	Stop     sql.NullTime `json:"stop"`
-	NbrUsers int          `json:"nbrUsers"`
+	ID          int          `json:"id"`
+	Start       time.Time    `json:"start"`
+	Stop        sql.NullTime `json:"stop"`
+	NbrUsers    int          `json:"nbrUsers"`    // Users connected during the time-range
+	NbrSessions int          `json:"nbrSessions"` // Sessions open during the time-range, a user can have several
+	// Only in the time-ranges of a user (or of a session) : the number of sessions counted for it,
+	// and the number of sessions of the user open during the time-range. See Share.
+	Sessions     int `json:"sessions,omitempty"`
+	UserSessions int `json:"userSessions,omitempty"`
+	// Only in the time-ranges of a group : the number of its members connected during the time-range.
+	Users int `json:"users,omitempty"`
+}
+
+// The ways to share the consumption of a time-range between the users connected.
+const (
+	AttributionSessions = "sessions" // In proportion to their open sessions, a user with two sessions counts twice
+	AttributionUsers    = "users"    // Equally between the users, however many sessions they have
+)
+
+// Return the part of the consumption of the time-range attributed to the user (or session) it was returned for,
+// according to attribution (AttributionSessions or AttributionUsers).
+func (t TimeRange) Share(attribution string) float64 {
+	if t.Sessions == 0 { // Not the time-range of a user, or before a user could have several sessions
+		t.Sessions, t.UserSessions = 1, 1
+	}
+	if t.Users == 0 { // Not the time-range of a group : a single user
+		t.Users = 1
+	}
+	if attribution == AttributionUsers {
+		if t.NbrUsers == 0 {
+			return 0
+		}
+		return float64(t.Users*t.Sessions) / float64(t.UserSessions*t.NbrUsers)
+	}
+	if t.NbrSessions == 0 {
+		return 0
+	}
+	return float64(t.Sessions) / float64(t.NbrSessions)
+}
+
+const plageColumns = "id, start, stop, nbr_users, nbr_sessions"
+
+func scanTimeRange(row rowScanner) (TimeRange, error) {
+	var t TimeRange
+	err := row.Scan(&t.ID, &t.Start, &t.Stop, &t.NbrUsers, &t.NbrSessions)
+	return t, err
 }
 
 type Link struct {
@@ -26,178 +95,215 @@ type Link struct {
 	UserID       int           `json:"userid"`
 	StartPlageID int           `json:"startPlageID"`
 	EndPlageID   sql.NullInt32 `json:"endPlageID"`
+	SessionID    sql.NullInt32 `json:"sessionID"`
+	Overlaps     []int         `json:"overlaps"` // The other links of the user open at the same time
 }
 
-func ConnectDB(username, password, host, port, dbname string) *sql.DB {
-	connString := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		host, port, username, password, dbname)
-	db, err := sql.Open("postgres", connString)
+const linkColumns = "id, userID, startPlageID, endPlageID, sessionID"
 
-	if err != nil {
-		log.Fatal(err)
+func scanLink(row rowScanner) (Link, error) {
+	l := Link{Overlaps: []int{}}
+	err := row.Scan(&l.ID, &l.UserID, &l.StartPlageID, &l.EndPlageID, &l.SessionID)
+	return l, err
+}
+
+// Fill the Overlaps of the links : two links overlap if they share a time-range (an open link lasts until now).
+func setOverlaps(links []Link) {
+	end := func(l Link) int {
+		if l.EndPlageID.Valid {
+			return int(l.EndPlageID.Int32)
+		}
+		return int(^uint(0) >> 1)
 	}
-	if err := db.Ping(); err != nil {
-		log.Fatal("Couldn't achieve connection with database... ")
+	for i := range links {
+		for j := range links {
+			if i != j && links[i].StartPlageID <= end(links[j]) && links[j].StartPlageID <= end(links[i]) {
+				links[i].Overlaps = append(links[i].Overlaps, links[j].ID)
+			}
+		}
 	}
-
-	return db
 }
 
-func GetUsers(db *sql.DB) []User {
+func (s *SQLStore) GetUsers() ([]User, error) {
 
 	users := []User{}
-	rows, err := db.Query("select * from users")
+	rows, err := s.db.Query("select " + userColumns + " from users order by id")
 	if err != nil {
-		log.Fatal(err)
+		return nil, unavailable("get users", err)
 	}
 	defer rows.Close()
+	byID := map[int]int{} //Index of each user in users
 	for rows.Next() {
-		var u User
-		if err := rows.Scan(&u.ID, &u.Start_session, &u.End_session); err != nil {
-			log.Fatal(err)
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, unavailable("get users", err)
 		}
+		byID[u.ID] = len(users)
 		users = append(users, u)
 	}
 	if err := rows.Err(); err != nil {
-		log.Fatal(err)
+		return nil, unavailable("get users", err)
+	}
+
+	identities, err := s.getIdentities("")
+	if err != nil {
+		return nil, err
+	}
+	for userID, ids := range identities {
+		if i, ok := byID[userID]; ok {
+			users[i].Identities = ids
+		}
 	}
 
-	return users
+	return users, nil
 }
 
-func GetUsersIDs(db *sql.DB) []int {
+func (s *SQLStore) GetUsersIDs() ([]int, error) {
 	usersIDs := []int{}
 	var curID int
 
-	rows, err := db.Query("select id from users")
+	rows, err := s.db.Query("select id from users")
 	if err != nil {
-		log.Fatal(err)
+		return nil, unavailable("get users ids", err)
 	}
+	defer rows.Close()
 	for rows.Next() {
-		rows.Scan(&curID)
+		if err := rows.Scan(&curID); err != nil {
+			return nil, unavailable("get users ids", err)
+		}
 		usersIDs = append(usersIDs, curID)
 	}
-	return usersIDs
+	return usersIDs, unavailable("get users ids", rows.Err())
 }
 
-func GetUserById(db *sql.DB, id int) User {
-	var u User
-	row := db.QueryRow("select * from users where id = $1", id)
-	if err := row.Scan(&u.ID, &u.Start_session, &u.End_session); err != nil {
+// Return the user with this id, or ErrNotFound.
+func (s *SQLStore) GetUserById(id int) (User, error) {
+	u, err := scanUser(s.db.QueryRow("select "+userColumns+" from users where id = $1", id))
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			fmt.Println("No user with this ID !")
-		} else {
-			log.Fatal(err)
+			return u, notFound("no user with id %d", id)
 		}
+		return u, unavailable("get user", err)
+	}
+	identities, err := s.getIdentities(" where userID = $1", id)
+	if err != nil {
+		return u, err
 	}
-	return u
+	if identities[id] != nil {
+		u.Identities = identities[id]
+	}
+	return u, nil
 }
 
-func GetUserTimesById(db *sql.DB, id int) []Link {
-	var l []Link
-	rows, err := db.Query("select * from link where userID = $1", id)
+// Return the links of the user (one per session), with the other links each one overlapped.
+func (s *SQLStore) GetUserTimesById(id int) ([]Link, error) {
+	l := []Link{}
+	rows, err := s.db.Query("select "+linkColumns+" from link where userID = $1 order by id", id)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			fmt.Println("No user with this ID !")
-		} else {
-			log.Fatal(err)
-		}
+		return nil, unavailable("get links", err)
 	}
+	defer rows.Close()
 	for rows.Next() {
-		var lTemp Link
-		if err := rows.Scan(&lTemp.ID, &lTemp.UserID, &lTemp.StartPlageID, &lTemp.EndPlageID); err != nil {
-			log.Fatal(err)
+		lTemp, err := scanLink(rows)
+		if err != nil {
+			return nil, unavailable("get links", err)
 		}
 		l = append(l, lTemp)
 	}
-	return l
+	setOverlaps(l)
+	return l, unavailable("get links", rows.Err())
 }
 
-func GetUserTimes(db *sql.DB, id int) (timeRanges []TimeRange) {
+// Every time-range between the first and the last one of each link of the user, in a single query.
+// An open link lasts until the time-range that is still open.
+// The time-ranges a user went through in several sessions are returned once, with the number of these sessions.
+const userTimesQuery = `select link.userID, plages.id, plages.start, plages.stop, plages.nbr_users, plages.nbr_sessions, count(*)
+	from link join plages on plages.id >= link.startPlageID and plages.id <= coalesce(link.endPlageID,
+		(select id from plages where stop is null order by id desc limit 1))`
 
-	var startPlageID int
-	var endPlageID sql.NullInt64
+// Ends userTimesQuery, after its where clause.
+const userTimesGroupBy = ` group by link.userID, plages.id, plages.start, plages.stop, plages.nbr_users, plages.nbr_sessions
+	order by link.userID, plages.id`
 
-	timeRangeRows, err := db.Query("select startPlageID, endPlageID from link where userID = $1", id)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			fmt.Println("No user with this ID !")
-		} else {
-			log.Fatal(err)
-		}
-	}
-
-	for timeRangeRows.Next() {
-
-		if err := timeRangeRows.Scan(&startPlageID, &endPlageID); err != nil {
-			log.Fatal(err)
-		}
-		if !endPlageID.Valid {
-			db.QueryRow("select id from plages where stop is null").Scan(&endPlageID.Int64)
-		}
+func (s *SQLStore) GetUserTimes(id int) ([]TimeRange, error) {
+	timeRanges, err := s.queryUserTimes(userTimesQuery+" where link.userID = $1"+userTimesGroupBy, id)
+	return timeRanges[id], err
+}
 
-		for i := startPlageID; i <= int(endPlageID.Int64); i++ {
-			var t TimeRange
-			temp := db.QueryRow("select * from plages where id = $1", i)
-			if err := temp.Scan(&t.ID, &t.Start, &t.Stop, &t.NbrUsers); err != nil {
-				log.Fatal(err)
-			}
+// Same as GetUserTimes, but for all the users at once (by user id).
+func (s *SQLStore) GetAllUserTimes() (map[int][]TimeRange, error) {
+	return s.queryUserTimes(userTimesQuery + userTimesGroupBy)
+}
 
-			timeRanges = append(timeRanges, t)
+func (s *SQLStore) queryUserTimes(query string, args ...interface{}) (map[int][]TimeRange, error) {
+	timeRanges := map[int][]TimeRange{}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, unavailable("get user time-ranges", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int
+		var t TimeRange
+		if err := rows.Scan(&userID, &t.ID, &t.Start, &t.Stop, &t.NbrUsers, &t.NbrSessions, &t.Sessions); err != nil {
+			return nil, unavailable("get user time-ranges", err)
 		}
+		t.UserSessions = t.Sessions
+		timeRanges[userID] = append(timeRanges[userID], t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, unavailable("get user time-ranges", err)
 	}
 
-	return timeRanges
+	return timeRanges, nil
 }
 
-func GetTimeRanges(db *sql.DB) []TimeRange {
+func (s *SQLStore) GetTimeRanges() ([]TimeRange, error) {
 	timeRanges := []TimeRange{}
-	rows, err := db.Query("select * from plages")
+	rows, err := s.db.Query("select " + plageColumns + " from plages order by id")
 	if err != nil {
-		log.Fatal(err)
+		return nil, unavailable("get time-ranges", err)
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var t TimeRange
-		if err := rows.Scan(&t.ID, &t.Start, &t.Stop, &t.NbrUsers); err != nil {
-			log.Fatal(err)
+		t, err := scanTimeRange(rows)
+		if err != nil {
+			return nil, unavailable("get time-ranges", err)
 		}
 		timeRanges = append(timeRanges, t)
 	}
 	if err := rows.Err(); err != nil {
-		log.Fatal(err)
+		return nil, unavailable("get time-ranges", err)
 	}
 
-	return timeRanges
+	return timeRanges, nil
 }
 
-func GetEarliestTimeRange(id int, db *sql.DB) TimeRange {
+// Return the time-range during which the user connected for the first time, or ErrNotFound if they never did.
+func (s *SQLStore) GetEarliestTimeRange(id int) (TimeRange, error) {
 
 	var tID int
 	var t TimeRange
-	row := db.QueryRow("select startPlageID from link where userID = $1 order by id limit 1", id)
+	row := s.db.QueryRow("select startPlageID from link where userID = $1 order by id limit 1", id)
 	if err := row.Scan(&tID); err != nil {
-		log.Fatal(err)
-	}
-
-	row2 := db.QueryRow("select * from plages where id = $1", tID)
-	if err := row2.Scan(&t.ID, &t.Start, &t.Stop, &t.NbrUsers); err != nil {
-		log.Fatal(err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return t, notFound("user %d has never been connected", id)
+		}
+		return t, unavailable("get earliest time-range", err)
 	}
 
-	return t
+	return s.GetTimerangeById(tID)
 
 }
 
-func GetTimerangeById(db *sql.DB, id int) TimeRange {
-	var t TimeRange
-	row := db.QueryRow("select * from plages where id = $1", id)
-	if err := row.Scan(&t.ID, &t.Start, &t.Stop, &t.NbrUsers); err != nil {
+// Return the time-range with this id, or ErrNotFound.
+func (s *SQLStore) GetTimerangeById(id int) (TimeRange, error) {
+	t, err := scanTimeRange(s.db.QueryRow("select "+plageColumns+" from plages where id = $1", id))
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			fmt.Println("No timerange with this ID !")
-		} else {
-			log.Fatal(err)
+			return t, notFound("no time-range with id %d", id)
 		}
+		return t, unavailable("get time-range", err)
 	}
-	return t
+	return t, nil
 }
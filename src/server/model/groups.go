@@ -0,0 +1,268 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"maps"
+	"slices"
+)
+
+// The kinds of groups. The ranks of a group are computed among the groups of the same kind.
+const (
+	GroupTeam    = "team"
+	GroupProject = "project"
+)
+
+var groupKinds = []string{GroupTeam, GroupProject}
+
+// A Group gathers users whose consumption is reported together, like a team or a project.
+// A user can belong to several groups, and a group can be a subgroup of another one of the same kind :
+// the consumption of a group is the one of its members and of the members of all its subgroups.
+type Group struct {
+	ID       int           `json:"id"`
+	Name     string        `json:"name"`
+	Kind     string        `json:"kind"`
+	ParentID sql.NullInt32 `json:"parentID"`
+	Members  []int         `json:"members"` // Direct members only, see GetGroupMembers for all of them
+}
+
+// Ids of the group given as $1 and of all its subgroups.
+const subgroupsQuery = `with recursive subgroups(id) as (
+	select id from user_groups where id = $1
+	union select user_groups.id from user_groups join subgroups on user_groups.parentID = subgroups.id) `
+
+// Create a group of this kind. parentID is the id of the group it is part of, or 0 if it has none.
+// The parent must already exist and be of the same kind, so the hierarchy never has cycles. Return the id of the group.
+func (s *SQLStore) CreateGroup(name, kind string, parentID int) (int, error) {
+	if !slices.Contains(groupKinds, kind) {
+		return 0, invalidInput("unknown group kind %q, expected one of %v", kind, groupKinds)
+	}
+	if name == "" {
+		return 0, invalidInput("empty group name")
+	}
+	var id int
+	err := s.withTx(func(tx *sql.Tx) error {
+		parent := sql.NullInt32{}
+		if parentID != 0 {
+			var parentKind string
+			if err := tx.QueryRow("select kind from user_groups where id = $1", parentID).Scan(&parentKind); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return notFound("no group with id %d", parentID)
+				}
+				return err
+			}
+			if parentKind != kind {
+				return invalidInput("a %s can't be part of a %s", kind, parentKind)
+			}
+			parent = sql.NullInt32{Int32: int32(parentID), Valid: true}
+		}
+		var exists int
+		if err := tx.QueryRow("select count(*) from user_groups where kind = $1 and name = $2", kind, name).Scan(&exists); err != nil {
+			return err
+		}
+		if exists > 0 {
+			return invalidInput("there is already a %s named %q", kind, name)
+		}
+		return tx.QueryRow("insert into user_groups (name, kind, parentID) values ($1, $2, $3) returning id", name, kind, parent).Scan(&id)
+	})
+	return id, unavailable("create group", err)
+}
+
+// Return the groups of this kind (all of them if kind is empty), with their direct members.
+func (s *SQLStore) GetGroups(kind string) ([]Group, error) {
+	groups := []Group{}
+	rows, err := s.db.Query("select id, name, kind, parentID from user_groups where $1 = '' or kind = $1 order by id", kind)
+	if err != nil {
+		return nil, unavailable("get groups", err)
+	}
+	defer rows.Close()
+	byID := map[int]int{} //Index of each group in groups
+	for rows.Next() {
+		g := Group{Members: []int{}}
+		if err := rows.Scan(&g.ID, &g.Name, &g.Kind, &g.ParentID); err != nil {
+			return nil, unavailable("get groups", err)
+		}
+		byID[g.ID] = len(groups)
+		groups = append(groups, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, unavailable("get groups", err)
+	}
+
+	members, err := s.db.Query("select groupID, userID from group_members order by groupID, userID")
+	if err != nil {
+		return nil, unavailable("get group members", err)
+	}
+	defer members.Close()
+	for members.Next() {
+		var groupID, userID int
+		if err := members.Scan(&groupID, &userID); err != nil {
+			return nil, unavailable("get group members", err)
+		}
+		if i, ok := byID[groupID]; ok {
+			groups[i].Members = append(groups[i].Members, userID)
+		}
+	}
+	return groups, unavailable("get group members", members.Err())
+}
+
+// Return the group with this id and its direct members, or ErrNotFound.
+func (s *SQLStore) GetGroupById(id int) (Group, error) {
+	g := Group{Members: []int{}}
+	if err := s.db.QueryRow("select id, name, kind, parentID from user_groups where id = $1", id).
+		Scan(&g.ID, &g.Name, &g.Kind, &g.ParentID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return g, notFound("no group with id %d", id)
+		}
+		return g, unavailable("get group", err)
+	}
+	rows, err := s.db.Query("select userID from group_members where groupID = $1 order by userID", id)
+	if err != nil {
+		return g, unavailable("get group members", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return g, unavailable("get group members", err)
+		}
+		g.Members = append(g.Members, userID)
+	}
+	return g, unavailable("get group members", rows.Err())
+}
+
+// Add the user to the group. Adding a member twice does nothing.
+func (s *SQLStore) AddGroupMember(groupID, userID int) error {
+	err := s.withTx(func(tx *sql.Tx) error {
+		var exists int
+		if err := tx.QueryRow("select count(*) from user_groups where id = $1", groupID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists == 0 {
+			return notFound("no group with id %d", groupID)
+		}
+		if err := tx.QueryRow("select count(*) from users where id = $1", userID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists == 0 {
+			return notFound("no user with id %d", userID)
+		}
+		_, err := tx.Exec("insert into group_members (groupID, userID) values ($1, $2) ON CONFLICT DO NOTHING", groupID, userID)
+		return err
+	})
+	return unavailable("add group member", err)
+}
+
+// Remove the user from the group (not from its subgroups).
+func (s *SQLStore) RemoveGroupMember(groupID, userID int) error {
+	if _, err := s.db.Exec("delete from group_members where groupID = $1 and userID = $2", groupID, userID); err != nil {
+		return unavailable("remove group member", err)
+	}
+	return nil
+}
+
+// Return the ids of all the members of the group, including the members of its subgroups.
+func (s *SQLStore) GetGroupMembers(id int) ([]int, error) {
+	if _, err := s.GetGroupById(id); err != nil {
+		return nil, err
+	}
+	members := []int{}
+	rows, err := s.db.Query(subgroupsQuery+
+		"select distinct userID from group_members where groupID in (select id from subgroups) order by userID", id)
+	if err != nil {
+		return nil, unavailable("get group members", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, unavailable("get group members", err)
+		}
+		members = append(members, userID)
+	}
+	return members, unavailable("get group members", rows.Err())
+}
+
+// Return the time-ranges during which members of the group (see GetGroupMembers) were connected, in the order of time.
+// Each one counts all the members connected then, so that its Share is the one of the group.
+func (s *SQLStore) GetGroupTimes(id int) ([]TimeRange, error) {
+	if _, err := s.GetGroupById(id); err != nil {
+		return nil, err
+	}
+	byUser, err := s.queryUserTimes(subgroupsQuery+userTimesQuery+
+		" where link.userID in (select userID from group_members where groupID in (select id from subgroups))"+
+		userTimesGroupBy, id)
+	if err != nil {
+		return nil, err
+	}
+	return mergeUserTimes(byUser, keysOf(byUser)), nil
+}
+
+// Same as GetGroupTimes, for all the groups of this kind at once (by group id).
+func (s *SQLStore) GetAllGroupTimes(kind string) (map[int][]TimeRange, error) {
+	groups, err := s.GetGroups(kind)
+	if err != nil {
+		return nil, err
+	}
+	children := map[int][]int{}
+	for _, g := range groups {
+		if g.ParentID.Valid {
+			children[int(g.ParentID.Int32)] = append(children[int(g.ParentID.Int32)], g.ID)
+		}
+	}
+	direct := map[int][]int{}
+	for _, g := range groups {
+		direct[g.ID] = g.Members
+	}
+
+	byUser, err := s.GetAllUserTimes()
+	if err != nil {
+		return nil, err
+	}
+	timeRanges := map[int][]TimeRange{}
+	for _, g := range groups {
+		members := map[int]bool{}
+		todo := []int{g.ID}
+		for len(todo) > 0 {
+			cur := todo[len(todo)-1]
+			todo = append(todo[:len(todo)-1], children[cur]...)
+			for _, userID := range direct[cur] {
+				members[userID] = true
+			}
+		}
+		timeRanges[g.ID] = mergeUserTimes(byUser, keysOf(members))
+	}
+	return timeRanges, nil
+}
+
+// Return the time-ranges of the users as the ones of a group, each time-range once with the members and sessions
+// of all of them, in the order of the ids.
+func mergeUserTimes(byUser map[int][]TimeRange, users []int) []TimeRange {
+	merged := map[int]TimeRange{}
+	for _, userID := range users {
+		for _, t := range byUser[userID] {
+			if m, ok := merged[t.ID]; ok {
+				m.Users++
+				m.Sessions += t.Sessions
+				m.UserSessions += t.UserSessions
+				merged[t.ID] = m
+			} else {
+				t.Users = 1
+				merged[t.ID] = t
+			}
+		}
+	}
+	timeRanges := []TimeRange{}
+	for _, id := range slices.Sorted(maps.Keys(merged)) {
+		timeRanges = append(timeRanges, merged[id])
+	}
+	return timeRanges
+}
+
+func keysOf[V any](m map[int]V) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
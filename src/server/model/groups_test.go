@@ -0,0 +1,31 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeUserTimes(t *testing.T) {
+	// Time-ranges 1 and 2 have 4 users connected with 6 sessions, members 1 and 2 share the time-range 2
+	byUser := map[int][]TimeRange{
+		1: {{ID: 1, NbrUsers: 4, NbrSessions: 6, Sessions: 1, UserSessions: 1}, {ID: 2, NbrUsers: 4, NbrSessions: 6, Sessions: 2, UserSessions: 2}},
+		2: {{ID: 2, NbrUsers: 4, NbrSessions: 6, Sessions: 1, UserSessions: 1}, {ID: 3, NbrUsers: 1, NbrSessions: 1, Sessions: 1, UserSessions: 1}},
+		3: {{ID: 1, NbrUsers: 4, NbrSessions: 6, Sessions: 1, UserSessions: 1}}, // Not a member
+	}
+	merged := mergeUserTimes(byUser, []int{2, 1})
+	want := []TimeRange{
+		{ID: 1, NbrUsers: 4, NbrSessions: 6, Sessions: 1, UserSessions: 1, Users: 1},
+		{ID: 2, NbrUsers: 4, NbrSessions: 6, Sessions: 3, UserSessions: 3, Users: 2},
+		{ID: 3, NbrUsers: 1, NbrSessions: 1, Sessions: 1, UserSessions: 1, Users: 1},
+	}
+	if !reflect.DeepEqual(merged, want) {
+		t.Fatalf("got %+v\nwant %+v", merged, want)
+	}
+
+	// The share of the group is the sum of the shares of its members
+	for _, attribution := range []string{AttributionUsers, AttributionSessions} {
+		if got, sum := merged[1].Share(attribution), byUser[1][1].Share(attribution)+byUser[2][0].Share(attribution); got != sum {
+			t.Errorf("%s: share %g of the group, want %g", attribution, got, sum)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// A period during which the server was down : from the last heartbeat before it stopped to its restart.
+// The time-range open when it stopped ends at Start, the next one begins at Stop, so nobody is charged for it.
+type Downtime struct {
+	ID          int           `json:"id"`
+	Start       time.Time     `json:"start"`
+	Stop        time.Time     `json:"stop"`
+	LastPlageID sql.NullInt32 `json:"lastPlageID"`
+}
+
+// Record that the server is still running. DemarrageServeur closes the sessions left open by a crash
+// at the last time recorded, so it should be called often (see controller.RunHeartbeat).
+func (s *SQLStore) Heartbeat() error {
+	err := s.withTx(func(tx *sql.Tx) error {
+		return heartbeat(tx, time.Now().UTC())
+	})
+	return unavailable("heartbeat", err)
+}
+
+func heartbeat(tx *sql.Tx, t time.Time) error {
+	_, err := tx.Exec(`insert into heartbeat (id, last_alive) values (1, $1)
+		on conflict (id) do update set last_alive = excluded.last_alive`, t)
+	return err
+}
+
+// Return the last time the server was known to be running inside tx : its last heartbeat, or the start of the
+// open time-range if it is more recent. ok is false if there was no heartbeat yet (database of an older version).
+func lastAlive(tx *sql.Tx, openPlageStart time.Time) (t time.Time, ok bool, err error) {
+	if err = tx.QueryRow("select last_alive from heartbeat where id = 1").Scan(&t); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return t, false, nil
+		}
+		return t, false, err
+	}
+	if openPlageStart.After(t) {
+		t = openPlageStart
+	}
+	return t.UTC(), true, nil
+}
+
+// Return all the downtimes of the server, the oldest first.
+func (s *SQLStore) GetDowntimes() ([]Downtime, error) {
+	downtimes := []Downtime{}
+	rows, err := s.db.Query("select id, start, stop, lastPlageID from downtimes order by id")
+	if err != nil {
+		return nil, unavailable("get downtimes", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d Downtime
+		if err := rows.Scan(&d.ID, &d.Start, &d.Stop, &d.LastPlageID); err != nil {
+			return nil, unavailable("get downtimes", err)
+		}
+		downtimes = append(downtimes, d)
+	}
+	return downtimes, unavailable("get downtimes", rows.Err())
+}
@@ -0,0 +1,261 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+)
+
+// The kinds of external identities a user can be known by.
+const (
+	IdentityUsername = "username" // Unix login
+	IdentitySSHKey   = "ssh"      // Fingerprint of an ssh public key, like SHA256:...
+	IdentityOIDC     = "oidc"     // Subject (sub claim) given by an OpenID Connect provider
+)
+
+var identityKinds = []string{IdentityUsername, IdentitySSHKey, IdentityOIDC}
+
+// An Identity is a name given to a user outside of this server. The login hooks only know these,
+// so they connect the users with ExternalUserConnection instead of choosing integer ids themselves.
+// Each identity belongs to a single user, but a user can have several (a username and some ssh keys...).
+type Identity struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+// Return an error wrapping ErrInvalidInput if the identity can't be stored.
+func (i Identity) validate() error {
+	if !slices.Contains(identityKinds, i.Kind) {
+		return invalidInput("unknown identity kind %q, expected one of %v", i.Kind, identityKinds)
+	}
+	if i.Value == "" {
+		return invalidInput("empty %s identity", i.Kind)
+	}
+	return nil
+}
+
+// Return the identities of the users (by user id) selected by the where clause, in the order they were added.
+func (s *SQLStore) getIdentities(where string, args ...interface{}) (map[int][]Identity, error) {
+	identities := map[int][]Identity{}
+	rows, err := s.db.Query("select userID, kind, value from identities"+where+" order by id", args...)
+	if err != nil {
+		return nil, unavailable("get identities", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int
+		var i Identity
+		if err := rows.Scan(&userID, &i.Kind, &i.Value); err != nil {
+			return nil, unavailable("get identities", err)
+		}
+		identities[userID] = append(identities[userID], i)
+	}
+	return identities, unavailable("get identities", rows.Err())
+}
+
+// Return the id of the user known by identity. If nobody is and create is true, a new user is created with it,
+// else the error wraps ErrNotFound.
+func (s *SQLStore) resolveIdentity(tx *sql.Tx, identity Identity, create bool) (int, error) {
+	var id int
+	err := tx.QueryRow("select userID from identities where kind = $1 and value = $2", identity.Kind, identity.Value).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	if !create {
+		return 0, notFound("no user with the %s identity %q", identity.Kind, identity.Value)
+	}
+	// The id comes from the sequence of the table, which UserConnection keeps after the ids its callers choose
+	if err := tx.QueryRow(`insert into users (start_session, end_session, display_name) values ($1, NULL, $2) returning id`,
+		time.Now().UTC(), identity.Value).Scan(&id); err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("insert into identities (userID, kind, value) values ($1, $2, $3)", id, identity.Kind, identity.Value)
+	return id, err
+}
+
+// Return the user known by identity, or ErrNotFound.
+func (s *SQLStore) GetUserByExternalID(identity Identity) (User, error) {
+	if err := identity.validate(); err != nil {
+		return User{}, err
+	}
+	var id int
+	err := s.db.QueryRow("select userID from identities where kind = $1 and value = $2", identity.Kind, identity.Value).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return User{}, notFound("no user with the %s identity %q", identity.Kind, identity.Value)
+		}
+		return User{}, unavailable("get user by identity", err)
+	}
+	return s.GetUserById(id)
+}
+
+// Give one more identity to the user. If it already belongs to another user, the error wraps ErrInvalidInput.
+func (s *SQLStore) AddIdentity(id int, identity Identity) error {
+	if err := identity.validate(); err != nil {
+		return err
+	}
+	err := s.withTx(func(tx *sql.Tx) error {
+		var exists int
+		if err := tx.QueryRow("select count(*) from users where id = $1", id).Scan(&exists); err != nil {
+			return err
+		}
+		if exists == 0 {
+			return notFound("no user with id %d", id)
+		}
+		var owner int
+		err := tx.QueryRow("select userID from identities where kind = $1 and value = $2", identity.Kind, identity.Value).Scan(&owner)
+		switch {
+		case err == nil && owner == id:
+			return nil
+		case err == nil:
+			return invalidInput("the %s identity %q already belongs to user %d", identity.Kind, identity.Value, owner)
+		case !errors.Is(err, sql.ErrNoRows):
+			return err
+		}
+		_, err = tx.Exec("insert into identities (userID, kind, value) values ($1, $2, $3)", id, identity.Kind, identity.Value)
+		return err
+	})
+	return unavailable("add identity", err)
+}
+
+// Set the display name, team and labels of the user (a nil labels map removes all the labels).
+func (s *SQLStore) UpdateUserProfile(id int, displayName, team string, labels map[string]string) error {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	encoded, err := json.Marshal(labels)
+	if err != nil {
+		return invalidInput("labels: %v", err)
+	}
+	res, err := s.db.Exec("update users set display_name = $1, team = $2, labels = $3 where id = $4", displayName, team, string(encoded), id)
+	if err != nil {
+		return unavailable("update user profile", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFound("no user with id %d", id)
+	}
+	return nil
+}
+
+// Set the time zone the days, weeks, months and years of the user start in, an IANA name like Europe/Paris
+// (empty for the time zone of the server). If it is unknown, the error wraps ErrInvalidInput.
+func (s *SQLStore) SetUserTimezone(id int, timezone string) error {
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return invalidInput("unknown time zone %q", timezone)
+	}
+	res, err := s.db.Exec("update users set timezone = $1 where id = $2", timezone, id)
+	if err != nil {
+		return unavailable("set user time zone", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFound("no user with id %d", id)
+	}
+	return nil
+}
+
+// Same as UserConnection, for the user known by identity. If nobody is known by it yet, a new user is created
+// (with the identity value as display name). Return the id of the user.
+func (s *SQLStore) ExternalUserConnection(identity Identity, info SessionInfo, actor string) (int, error) {
+	session, err := s.OpenExternalSession(identity, info, time.Time{}, actor, "")
+	return session.UserID, err
+}
+
+// Same as ExternalUserConnection, but return the session opened, so that it can be closed alone with CloseSession.
+// at is when the session opened, now if it is the zero time, see OpenSession.
+// If requestKey is not empty and a session was already opened with it, nothing is done and that session is returned.
+func (s *SQLStore) OpenExternalSession(identity Identity, info SessionInfo, at time.Time, actor, requestKey string) (Session, error) {
+	if err := identity.validate(); err != nil {
+		return Session{}, err
+	}
+	at, err := eventTime(at)
+	if err != nil {
+		return Session{}, err
+	}
+	sessionID, err := s.withRequestKey(requestKey, "open_session", func(tx *sql.Tx) (int, error) {
+		if _, err := tx.Exec("select id from plages where stop is null" + s.dialect.forUpdate); err != nil {
+			return 0, err
+		}
+		id, err := s.resolveIdentity(tx, identity, true)
+		if err != nil {
+			return 0, err
+		}
+		return s.userConnection(tx, id, info, at, actor)
+	})
+	if err != nil {
+		return Session{}, unavailable("connection of the user", err)
+	}
+	return s.GetSessionById(sessionID)
+}
+
+// Create a user with this profile (see UpdateUserProfile) and these identities, without connecting it.
+// If one of the identities already belongs to someone, the error wraps ErrInvalidInput and nothing is created.
+// If requestKey is not empty and a user was already created with it, nothing is done and that user is returned.
+func (s *SQLStore) CreateUser(displayName, team string, labels map[string]string, identities []Identity, actor, requestKey string) (User, error) {
+	for _, identity := range identities {
+		if err := identity.validate(); err != nil {
+			return User{}, err
+		}
+	}
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	encoded, err := json.Marshal(labels)
+	if err != nil {
+		return User{}, invalidInput("labels: %v", err)
+	}
+	id, err := s.withRequestKey(requestKey, "create_user", func(tx *sql.Tx) (int, error) {
+		// Locked like in UserConnection, so that an id chosen by its caller isn't allocated here at the same time
+		if _, err := tx.Exec("select id from plages where stop is null" + s.dialect.forUpdate); err != nil {
+			return 0, err
+		}
+		var id int
+		if err := tx.QueryRow(`insert into users (start_session, end_session, display_name, team, labels)
+			values ($1, NULL, $2, $3, $4) returning id`,
+			time.Now().UTC(), displayName, team, string(encoded)).Scan(&id); err != nil {
+			return 0, err
+		}
+		identityIDs := []int{}
+		for _, identity := range identities {
+			var owner int
+			err := tx.QueryRow("select userID from identities where kind = $1 and value = $2", identity.Kind, identity.Value).Scan(&owner)
+			if err == nil {
+				return 0, invalidInput("the %s identity %q already belongs to user %d", identity.Kind, identity.Value, owner)
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return 0, err
+			}
+			var identityID int
+			if err := tx.QueryRow("insert into identities (userID, kind, value) values ($1, $2, $3) returning id",
+				id, identity.Kind, identity.Value).Scan(&identityID); err != nil {
+				return 0, err
+			}
+			identityIDs = append(identityIDs, identityID)
+		}
+		// Only the ids : the values (usernames, emails...) must not stay in the audit log
+		return id, writeAudit(tx, actor, AuditCreateUser, id, nil, map[string]interface{}{"identityIDs": identityIDs})
+	})
+	if err != nil {
+		return User{}, unavailable("create user", err)
+	}
+	return s.GetUserById(id)
+}
+
+// Same as UserDeconnection, for the user known by identity. If nobody is, the error wraps ErrNotFound.
+func (s *SQLStore) ExternalUserDeconnection(identity Identity, actor string) error {
+	if err := identity.validate(); err != nil {
+		return err
+	}
+	err := s.withTx(func(tx *sql.Tx) error {
+		id, err := s.resolveIdentity(tx, identity, false)
+		if err != nil {
+			return err
+		}
+		return s.userDeconnection(tx, id, actor)
+	})
+	return unavailable("disconnection of the user", err)
+}
@@ -0,0 +1,201 @@
+package model
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The schema of the session database is described by the numbered files of the migrations folder, with one
+// subfolder per dialect (postgres, sqlite) : NNNN_name.up.sql applies the change and NNNN_name.down.sql reverts it.
+// Both folders must have the same versions. The versions already applied are stored in the schema_migrations table,
+// so a change of the schema never needs a Reset anymore.
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+// State of a migration in the database, as shown by the "migrate status" command.
+type MigrationState struct {
+	Version   int          `json:"version"`
+	Name      string       `json:"name"`
+	AppliedAt sql.NullTime `json:"appliedAt"`
+}
+
+// Return all the migrations of the dialect embedded in the binary, sorted by version.
+func Migrations(dialectName string) ([]Migration, error) {
+	files, err := fs.Glob(migrationFiles, "migrations/"+dialectName+"/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, file := range files {
+		base := path.Base(file)
+		prefix, rest, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("bad migration file name %s", base)
+		}
+		content, err := migrationFiles.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version}
+			byVersion[version] = m
+		}
+		switch {
+		case strings.HasSuffix(rest, ".up.sql"):
+			m.Name = strings.TrimSuffix(rest, ".up.sql")
+			m.up = string(content)
+		case strings.HasSuffix(rest, ".down.sql"):
+			m.down = string(content)
+		default:
+			return nil, fmt.Errorf("bad migration file name %s", base)
+		}
+	}
+
+	var migrations []Migration
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d needs both an up and a down file", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+	return migrations, nil
+}
+
+func (s *SQLStore) ensureMigrationsTable() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name text NOT NULL,
+		applied_at TIMESTAMP NOT NULL)`)
+	return err
+}
+
+// Return the versions already applied, with the time they were applied at.
+func (s *SQLStore) appliedMigrations() (map[int]time.Time, error) {
+	if err := s.ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query("select version, applied_at from schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var t time.Time
+		if err := rows.Scan(&version, &t); err != nil {
+			return nil, err
+		}
+		applied[version] = t
+	}
+	return applied, rows.Err()
+}
+
+// Run the sql of a migration and record it (or forget it when going down) in the same transaction.
+func (s *SQLStore) runMigration(m Migration, up bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if up {
+		if _, err := tx.Exec(m.up); err != nil {
+			return fmt.Errorf("migration %04d_%s up: %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec("insert into schema_migrations (version, name, applied_at) values ($1, $2, $3)",
+			m.Version, m.Name, time.Now().UTC()); err != nil {
+			return err
+		}
+	} else {
+		if _, err := tx.Exec(m.down); err != nil {
+			return fmt.Errorf("migration %04d_%s down: %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec("delete from schema_migrations where version = $1", m.Version); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Apply all the migrations that are not applied yet, in order. Return the number of migrations applied.
+func (s *SQLStore) Migrate() (int, error) {
+	migrations, err := Migrations(s.dialect.name)
+	if err != nil {
+		return 0, err
+	}
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := s.runMigration(m, true); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Revert the last steps applied migrations, most recent first. Return the number of migrations reverted.
+func (s *SQLStore) Rollback(steps int) (int, error) {
+	migrations, err := Migrations(s.dialect.name)
+	if err != nil {
+		return 0, err
+	}
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+		if _, ok := applied[migrations[i].Version]; !ok {
+			continue
+		}
+		if err := s.runMigration(migrations[i], false); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Return every known migration, and when it was applied (invalid time if it is still pending).
+func (s *SQLStore) MigrationStatus() ([]MigrationState, error) {
+	migrations, err := Migrations(s.dialect.name)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var states []MigrationState
+	for _, m := range migrations {
+		t, ok := applied[m.Version]
+		states = append(states, MigrationState{Version: m.Version, Name: m.Name, AppliedAt: sql.NullTime{Time: t, Valid: ok}})
+	}
+	return states, nil
+}
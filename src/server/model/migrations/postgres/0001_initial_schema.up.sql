@@ -0,0 +1,18 @@
+-- Tables of the first versions of the server. IF NOT EXISTS lets the databases created
+-- before the migrations were introduced adopt them without losing their history.
+CREATE TABLE IF NOT EXISTS users (
+	id SERIAL PRIMARY KEY,
+	start_session TIMESTAMP NOT NULL,
+	end_session TIMESTAMP);
+
+CREATE TABLE IF NOT EXISTS plages (
+	id serial PRIMARY KEY,
+	start TIMESTAMP,
+	stop TIMESTAMP,
+	nbr_users integer);
+
+CREATE TABLE IF NOT EXISTS link (
+	id serial PRIMARY KEY,
+	userID integer NOT NULL references users (id),
+	startPlageID integer NOT NULL references plages (id),
+	endPlageID integer references plages (id));
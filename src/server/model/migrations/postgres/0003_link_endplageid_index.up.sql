@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS link_endplageid_idx ON link (endPlageID);
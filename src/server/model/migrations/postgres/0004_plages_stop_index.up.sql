@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS plages_stop_idx ON plages (stop);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS identities;
+ALTER TABLE users DROP COLUMN IF EXISTS labels;
+ALTER TABLE users DROP COLUMN IF EXISTS team;
+ALTER TABLE users DROP COLUMN IF EXISTS display_name;
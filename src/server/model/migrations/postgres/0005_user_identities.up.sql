@@ -0,0 +1,14 @@
+-- Users carry a display name, a team and free labels (a json object of strings),
+-- and can be found by the identities the login hooks know them by (username, ssh key fingerprint, oidc subject).
+ALTER TABLE users ADD COLUMN display_name text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN team text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN labels text NOT NULL DEFAULT '{}';
+
+CREATE TABLE identities (
+	id serial PRIMARY KEY,
+	userID integer NOT NULL references users (id) ON DELETE CASCADE,
+	kind text NOT NULL,
+	value text NOT NULL,
+	UNIQUE (kind, value));
+
+CREATE INDEX identities_userid_idx ON identities (userID);
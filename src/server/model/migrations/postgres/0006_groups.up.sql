@@ -0,0 +1,17 @@
+-- Teams and projects. A user can belong to any number of groups, and a group can be part of a bigger one
+-- of the same kind (its parent) : the members of a group are its own members and the ones of all its subgroups.
+CREATE TABLE user_groups (
+	id serial PRIMARY KEY,
+	name text NOT NULL,
+	kind text NOT NULL,
+	parentID integer references user_groups (id) ON DELETE CASCADE,
+	UNIQUE (kind, name));
+
+CREATE INDEX user_groups_parentid_idx ON user_groups (parentID);
+
+CREATE TABLE group_members (
+	groupID integer NOT NULL references user_groups (id) ON DELETE CASCADE,
+	userID integer NOT NULL references users (id) ON DELETE CASCADE,
+	PRIMARY KEY (groupID, userID));
+
+CREATE INDEX group_members_userid_idx ON group_members (userID);
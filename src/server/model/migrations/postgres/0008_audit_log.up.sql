@@ -0,0 +1,11 @@
+-- Record of the administrative changes (erasures of users...). userID has no foreign key,
+-- the entries must stay after the user is deleted.
+CREATE TABLE audit_log (
+	id serial PRIMARY KEY,
+	at TIMESTAMP NOT NULL,
+	actor text NOT NULL,
+	action text NOT NULL,
+	userID integer,
+	details text NOT NULL DEFAULT '{}');
+
+CREATE INDEX audit_log_userid_idx ON audit_log (userID, at);
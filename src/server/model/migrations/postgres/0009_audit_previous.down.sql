@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS audit_log_no_update ON audit_log;
+DROP FUNCTION IF EXISTS audit_log_append_only();
+ALTER TABLE audit_log DROP COLUMN IF EXISTS previous;
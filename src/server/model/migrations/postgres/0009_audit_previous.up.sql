@@ -0,0 +1,12 @@
+-- The values changed by an action, as they were before it (json, null if nothing was changed).
+ALTER TABLE audit_log ADD COLUMN previous text;
+
+-- The entries can only be added : updating or deleting one fails. Dropping the table is still possible (migrate down).
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE OR DELETE ON audit_log
+	FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
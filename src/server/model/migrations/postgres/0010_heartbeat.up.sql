@@ -0,0 +1,11 @@
+-- Last time the server was known to be running, updated periodically by the heartbeat (a single row).
+CREATE TABLE heartbeat (
+	id integer PRIMARY KEY CHECK (id = 1),
+	last_alive TIMESTAMP NOT NULL);
+
+-- The periods the server was down, from its last heartbeat to its restart. Nobody is connected during them.
+CREATE TABLE downtimes (
+	id serial PRIMARY KEY,
+	start TIMESTAMP NOT NULL,
+	stop TIMESTAMP NOT NULL,
+	lastPlageID integer references plages (id));
@@ -0,0 +1,2 @@
+-- Last heartbeat of the client of the session, null if it never sent any (it is then never disconnected for being idle).
+ALTER TABLE sessions ADD COLUMN last_seen TIMESTAMP;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS link_sessionid_idx;
+ALTER TABLE link DROP COLUMN IF EXISTS sessionID;
+ALTER TABLE plages DROP COLUMN IF EXISTS nbr_sessions;
@@ -0,0 +1,11 @@
+-- A user can now have several sessions open at the same time, each with its own link.
+-- nbr_users counts the users connected during the time-range, nbr_sessions their open sessions
+-- (the same until now, a user could only have one).
+ALTER TABLE plages ADD COLUMN nbr_sessions integer NOT NULL DEFAULT 0;
+UPDATE plages SET nbr_sessions = coalesce(nbr_users, 0);
+
+-- The session of each link, rebuilt from the time-range they started with
+ALTER TABLE link ADD COLUMN sessionID integer references sessions (id) ON DELETE SET NULL;
+UPDATE link SET sessionID = (select min(sessions.id) from sessions
+	where sessions.userID = link.userID and sessions.startPlageID = link.startPlageID);
+CREATE INDEX link_sessionid_idx ON link (sessionID);
@@ -0,0 +1,7 @@
+-- The keys given by the clients with their write requests (Idempotency-Key header), and the id of what each one created,
+-- so that a request sent again gets the same answer instead of creating a second user or session.
+CREATE TABLE request_keys (
+	request_key text PRIMARY KEY,
+	endpoint text NOT NULL,
+	resultID integer NOT NULL,
+	created_at TIMESTAMP NOT NULL);
@@ -0,0 +1,6 @@
+ALTER TABLE sessions ADD COLUMN startPlageID integer references plages (id);
+ALTER TABLE sessions ADD COLUMN endPlageID integer references plages (id);
+UPDATE sessions SET startPlageID = link.startPlageID, endPlageID = link.endPlageID FROM link WHERE link.sessionID = sessions.id;
+
+DROP TABLE IF EXISTS session_events;
+DROP FUNCTION IF EXISTS session_events_append_only();
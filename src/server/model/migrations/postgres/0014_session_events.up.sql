@@ -0,0 +1,35 @@
+-- The sessions are recorded as an append-only stream of events : one connect event when a session opens, one disconnect
+-- event when it closes, each at the time it happened (before the time it was recorded for the events sent late by remote
+-- agents or backfilled). The time-ranges and the links are derived from them, see derivePlages.
+CREATE TABLE session_events (
+	id serial PRIMARY KEY,
+	sessionID integer NOT NULL references sessions (id) ON DELETE CASCADE,
+	kind text NOT NULL CHECK (kind IN ('connect', 'disconnect')),
+	at TIMESTAMP NOT NULL,
+	recorded_at TIMESTAMP NOT NULL,
+	source text NOT NULL DEFAULT '');
+
+CREATE UNIQUE INDEX session_events_session_idx ON session_events (sessionID, kind);
+
+-- The events can't be changed. They are only deleted with their session, when its user is erased.
+-- (OR REPLACE : Reset drops the table but not the function.)
+CREATE OR REPLACE FUNCTION session_events_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'session_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER session_events_no_update BEFORE UPDATE ON session_events
+	FOR EACH ROW EXECUTE FUNCTION session_events_append_only();
+
+-- The events of the sessions recorded before, in the order of time
+INSERT INTO session_events (sessionID, kind, at, recorded_at, source)
+	SELECT sessionID, kind, at, at, 'migration' FROM (
+		SELECT id AS sessionID, 'connect' AS kind, start AS at FROM sessions
+		UNION ALL
+		SELECT id, 'disconnect', stop FROM sessions WHERE stop IS NOT NULL) AS events
+	ORDER BY at, sessionID, kind;
+
+-- The time-ranges of a session are the ones of its link
+ALTER TABLE sessions DROP COLUMN startPlageID;
+ALTER TABLE sessions DROP COLUMN endPlageID;
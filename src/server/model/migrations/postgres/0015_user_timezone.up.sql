@@ -0,0 +1,3 @@
+-- The time zone (IANA name like Europe/Paris) the days, weeks, months and years of a user start in,
+-- empty for the one of the server (DEFAULT_TIMEZONE in the config).
+ALTER TABLE users ADD COLUMN timezone text NOT NULL DEFAULT '';
@@ -0,0 +1,14 @@
+-- The entries about a user are redacted when the user is erased : their user, previous values and details are removed.
+-- It is the only change the append-only trigger lets through.
+ALTER TABLE audit_log ADD COLUMN redacted boolean NOT NULL DEFAULT false;
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'UPDATE' AND NOT OLD.redacted AND NEW.redacted AND NEW.id = OLD.id AND NEW.at = OLD.at
+		AND NEW.actor = OLD.actor AND NEW.action = OLD.action
+		AND NEW.userID IS NULL AND NEW.previous IS NULL AND NEW.details = '{}' THEN
+		RETURN NEW;
+	END IF;
+	RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,2 @@
+-- The sequence is left where it is : moving it back could give the ids of users deleted since.
+SELECT 1;
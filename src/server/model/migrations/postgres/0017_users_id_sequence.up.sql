@@ -0,0 +1,5 @@
+-- The users created with an id chosen by the caller (UserConnection) didn't move the sequence of the table,
+-- which could then give an id already taken. It is moved past the largest id once, UserConnection keeps it there since.
+SELECT setval(pg_get_serial_sequence('users', 'id'),
+	greatest(max(id), coalesce(pg_sequence_last_value(pg_get_serial_sequence('users', 'id')::regclass), 0)))
+FROM users HAVING max(id) IS NOT NULL;
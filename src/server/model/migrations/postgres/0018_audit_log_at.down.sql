@@ -0,0 +1 @@
+DROP INDEX IF EXISTS audit_log_at_idx;
@@ -0,0 +1,2 @@
+-- The audit log is read by time window (GetAuditLog), for all the users too.
+CREATE INDEX audit_log_at_idx ON audit_log (at);
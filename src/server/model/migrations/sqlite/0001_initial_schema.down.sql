@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS link;
+DROP TABLE IF EXISTS plages;
+DROP TABLE IF EXISTS users;
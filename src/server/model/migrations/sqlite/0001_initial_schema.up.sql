@@ -0,0 +1,18 @@
+-- Same tables as the postgres schema. The times are stored as text by the driver,
+-- always in UTC so that they keep their order.
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	start_session TIMESTAMP NOT NULL,
+	end_session TIMESTAMP);
+
+CREATE TABLE IF NOT EXISTS plages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	start TIMESTAMP,
+	stop TIMESTAMP,
+	nbr_users integer);
+
+CREATE TABLE IF NOT EXISTS link (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	userID integer NOT NULL references users (id),
+	startPlageID integer NOT NULL references plages (id),
+	endPlageID integer references plages (id));
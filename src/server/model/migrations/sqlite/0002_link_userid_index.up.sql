@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS link_userid_idx ON link (userID);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS link_endplageid_idx;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS plages_stop_idx;
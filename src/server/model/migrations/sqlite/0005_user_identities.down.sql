@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS identities;
+ALTER TABLE users DROP COLUMN labels;
+ALTER TABLE users DROP COLUMN team;
+ALTER TABLE users DROP COLUMN display_name;
@@ -0,0 +1,13 @@
+-- Same as the postgres migration. The labels are a json object of strings stored as text.
+ALTER TABLE users ADD COLUMN display_name text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN team text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN labels text NOT NULL DEFAULT '{}';
+
+CREATE TABLE identities (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	userID integer NOT NULL references users (id) ON DELETE CASCADE,
+	kind text NOT NULL,
+	value text NOT NULL,
+	UNIQUE (kind, value));
+
+CREATE INDEX identities_userid_idx ON identities (userID);
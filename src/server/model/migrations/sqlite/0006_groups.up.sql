@@ -0,0 +1,16 @@
+-- Same as the postgres migration. The table is named user_groups since groups is a keyword of sqlite.
+CREATE TABLE user_groups (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name text NOT NULL,
+	kind text NOT NULL,
+	parentID integer references user_groups (id) ON DELETE CASCADE,
+	UNIQUE (kind, name));
+
+CREATE INDEX user_groups_parentid_idx ON user_groups (parentID);
+
+CREATE TABLE group_members (
+	groupID integer NOT NULL references user_groups (id) ON DELETE CASCADE,
+	userID integer NOT NULL references users (id) ON DELETE CASCADE,
+	PRIMARY KEY (groupID, userID));
+
+CREATE INDEX group_members_userid_idx ON group_members (userID);
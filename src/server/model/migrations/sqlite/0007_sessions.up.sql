@@ -0,0 +1,24 @@
+-- Same as the postgres migration.
+CREATE TABLE sessions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	userID integer NOT NULL references users (id) ON DELETE CASCADE,
+	start TIMESTAMP NOT NULL,
+	stop TIMESTAMP,
+	host text NOT NULL DEFAULT '',
+	source_ip text NOT NULL DEFAULT '',
+	client_type text NOT NULL DEFAULT '',
+	startPlageID integer NOT NULL references plages (id),
+	endPlageID integer references plages (id),
+	energy REAL,
+	energy_unit text NOT NULL DEFAULT '',
+	computed_at TIMESTAMP);
+
+CREATE INDEX sessions_userid_idx ON sessions (userID);
+CREATE INDEX sessions_energy_idx ON sessions (stop) WHERE energy IS NULL;
+
+-- The sessions that happened before are rebuilt from the links
+INSERT INTO sessions (userID, start, stop, startPlageID, endPlageID)
+	SELECT link.userID, startPlage.start, endPlage.stop, link.startPlageID, link.endPlageID
+	FROM link JOIN plages startPlage ON startPlage.id = link.startPlageID
+	LEFT JOIN plages endPlage ON endPlage.id = link.endPlageID
+	ORDER BY link.id;
@@ -0,0 +1,10 @@
+-- Same as the postgres migration.
+CREATE TABLE audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	at TIMESTAMP NOT NULL,
+	actor text NOT NULL,
+	action text NOT NULL,
+	userID integer,
+	details text NOT NULL DEFAULT '{}');
+
+CREATE INDEX audit_log_userid_idx ON audit_log (userID, at);
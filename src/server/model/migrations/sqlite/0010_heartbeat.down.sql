@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS downtimes;
+DROP TABLE IF EXISTS heartbeat;
@@ -0,0 +1,10 @@
+-- Same as the postgres migration.
+CREATE TABLE heartbeat (
+	id integer PRIMARY KEY CHECK (id = 1),
+	last_alive TIMESTAMP NOT NULL);
+
+CREATE TABLE downtimes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	start TIMESTAMP NOT NULL,
+	stop TIMESTAMP NOT NULL,
+	lastPlageID integer references plages (id));
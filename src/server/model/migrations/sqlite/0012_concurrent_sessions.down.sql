@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS link_sessionid_idx;
+ALTER TABLE link DROP COLUMN sessionID;
+ALTER TABLE plages DROP COLUMN nbr_sessions;
@@ -0,0 +1,8 @@
+-- Same as the postgres migration.
+ALTER TABLE plages ADD COLUMN nbr_sessions integer NOT NULL DEFAULT 0;
+UPDATE plages SET nbr_sessions = coalesce(nbr_users, 0);
+
+ALTER TABLE link ADD COLUMN sessionID integer references sessions (id) ON DELETE SET NULL;
+UPDATE link SET sessionID = (select min(sessions.id) from sessions
+	where sessions.userID = link.userID and sessions.startPlageID = link.startPlageID);
+CREATE INDEX link_sessionid_idx ON link (sessionID);
@@ -0,0 +1,6 @@
+-- Same as the postgres migration.
+CREATE TABLE request_keys (
+	request_key text PRIMARY KEY,
+	endpoint text NOT NULL,
+	resultID integer NOT NULL,
+	created_at TIMESTAMP NOT NULL);
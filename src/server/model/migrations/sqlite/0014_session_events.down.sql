@@ -0,0 +1,7 @@
+-- Same as the postgres migration. startPlageID stays nullable : sqlite can't add a column with NOT NULL and a foreign key.
+ALTER TABLE sessions ADD COLUMN startPlageID integer references plages (id);
+ALTER TABLE sessions ADD COLUMN endPlageID integer references plages (id);
+UPDATE sessions SET startPlageID = (SELECT startPlageID FROM link WHERE link.sessionID = sessions.id),
+	endPlageID = (SELECT endPlageID FROM link WHERE link.sessionID = sessions.id);
+
+DROP TABLE IF EXISTS session_events;
@@ -0,0 +1,25 @@
+-- Same as the postgres migration.
+CREATE TABLE session_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	sessionID integer NOT NULL references sessions (id) ON DELETE CASCADE,
+	kind text NOT NULL CHECK (kind IN ('connect', 'disconnect')),
+	at TIMESTAMP NOT NULL,
+	recorded_at TIMESTAMP NOT NULL,
+	source text NOT NULL DEFAULT '');
+
+CREATE UNIQUE INDEX session_events_session_idx ON session_events (sessionID, kind);
+
+CREATE TRIGGER session_events_no_update BEFORE UPDATE ON session_events
+BEGIN
+	SELECT RAISE(ABORT, 'session_events is append-only');
+END;
+
+INSERT INTO session_events (sessionID, kind, at, recorded_at, source)
+	SELECT sessionID, kind, at, at, 'migration' FROM (
+		SELECT id AS sessionID, 'connect' AS kind, start AS at FROM sessions
+		UNION ALL
+		SELECT id, 'disconnect', stop FROM sessions WHERE stop IS NOT NULL)
+	ORDER BY sessionID, kind;
+
+ALTER TABLE sessions DROP COLUMN startPlageID;
+ALTER TABLE sessions DROP COLUMN endPlageID;
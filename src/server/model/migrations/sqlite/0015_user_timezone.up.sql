@@ -0,0 +1,2 @@
+-- Same as the postgres migration.
+ALTER TABLE users ADD COLUMN timezone text NOT NULL DEFAULT '';
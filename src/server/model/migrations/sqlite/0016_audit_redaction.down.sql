@@ -0,0 +1,7 @@
+DROP TRIGGER IF EXISTS audit_log_no_update;
+ALTER TABLE audit_log DROP COLUMN redacted;
+
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN
+	SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
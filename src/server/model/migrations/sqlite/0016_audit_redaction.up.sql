@@ -0,0 +1,11 @@
+-- Same as the postgres migration.
+ALTER TABLE audit_log ADD COLUMN redacted integer NOT NULL DEFAULT 0;
+
+DROP TRIGGER IF EXISTS audit_log_no_update;
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+WHEN NOT (OLD.redacted = 0 AND NEW.redacted = 1 AND NEW.id = OLD.id AND NEW.at = OLD.at
+	AND NEW.actor = OLD.actor AND NEW.action = OLD.action
+	AND NEW.userID IS NULL AND NEW.previous IS NULL AND NEW.details = '{}')
+BEGIN
+	SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
@@ -0,0 +1,2 @@
+-- Nothing to do : with AUTOINCREMENT, sqlite already allocates the ids after the ones chosen by the callers.
+SELECT 1;
@@ -0,0 +1,3 @@
+-- Same as the postgres migration, on the times as compared by GetAuditLog (see sqliteDialect.orderedTime) : sqlite
+-- stores them as text that doesn't sort in the order of time.
+CREATE INDEX audit_log_at_idx ON audit_log (strftime('%Y-%m-%d %H:%M:%f', replace(at, ' +0000 UTC', '')));
@@ -15,12 +15,108 @@ import (
 type Point struct {
 	Timestamp time.Time `json:"timestamp"`
 	Value     float64   `json:"value"`
+	Tags      Tags      `json:"tags"`
+	Count     int       `json:"count,omitempty"` // Number of raw points summed in Value when the point is a rollup
+	Max       float64   `json:"max,omitempty"`   // Highest and lowest raw values of the window of a rollup point,
+	Min       float64   `json:"min,omitempty"`   // when the energy database keeps them (the influx rollups do)
 }
 
-var client influxdb2.Client
+// Return the number of raw points the point stands for (1 for a raw point).
+func (p Point) Weight() int {
+	if p.Count == 0 {
+		return 1
+	}
+	return p.Count
+}
+
+// Return the highest and the lowest raw values the point stands for : its value for a raw point, the max and min of its window
+// for a rollup. A rollup without them (computed by prometheus) only knows the mean of its window.
+func (p Point) Extremes() (float64, float64) {
+	switch {
+	case p.Count <= 1:
+		return p.Value, p.Value
+	case p.Max != 0 || p.Min != 0:
+		return p.Max, p.Min
+	}
+	mean := p.Value / float64(p.Count)
+	return mean, mean
+}
+
+// Return the point with its values multiplied by share, like the part of the consumption attributed to a user.
+func (p Point) Scaled(share float64) Point {
+	p.Value *= share
+	p.Max *= share
+	p.Min *= share
+	return p
+}
+
+// Tags tell where a point comes from. They are stored as influx tags, so that several servers
+// (or several sources on the same server) can write into the same bucket without mixing their data.
+// When used as a filter, empty fields match everything.
+type Tags struct {
+	Host    string `json:"host,omitempty"`    // Name of the monitored server
+	Source  string `json:"source,omitempty"`  // Tool that produced the value (rapl, demeter...)
+	Domain  string `json:"domain,omitempty"`  // Part of the hardware measured (package-0, cpu...)
+	Unit    string `json:"unit,omitempty"`    // J or mWh
+	Process string `json:"process,omitempty"` // Process name or cgroup, empty for the whole machine
+}
+
+var tagKeys = []string{"host", "source", "domain", "unit", "process"}
+
+// Return the tags as a map of influx tag key -> value, without the empty ones.
+func (t Tags) Map() map[string]string {
+	m := map[string]string{}
+	for i, v := range []string{t.Host, t.Source, t.Domain, t.Unit, t.Process} {
+		if v != "" {
+			m[tagKeys[i]] = v
+		}
+	}
+	return m
+}
 
-func CloseClient() {
-	client.Close()
+// Build the Tags from the values of a flux record (missing columns are left empty).
+func tagsFromRecord(values map[string]interface{}) Tags {
+	get := func(key string) string {
+		if v, ok := values[key].(string); ok {
+			return v
+		}
+		return ""
+	}
+	return Tags{Host: get("host"), Source: get("source"), Domain: get("domain"), Unit: get("unit"), Process: get("process")}
+}
+
+// Create the influx point corresponding to p, with its tags.
+func newEnergyPoint(p Point) *write.Point {
+	return influxdb2.NewPoint("energy", p.Tags.Map(), map[string]interface{}{"energyConsumption": p.Value}, p.Timestamp)
+}
+
+// Influx owns the connection to the influx database. It is created once at startup with NewInflux,
+// shared by every goroutine (the underlying client is safe for concurrent use), and closed once with Close
+// when the server shuts down.
+type Influx struct {
+	client    influxdb2.Client
+	org       string
+	bucket    string
+	closeOnce sync.Once
+
+	tiers    []Tier
+	rollupMu sync.Mutex
+	rolled   map[int]time.Time // Time until which each rollup tier has been computed
+}
+
+// Connect to the influx database. The raw points are written in bucket, and the rollups of the
+// given tiers (the first one being the raw points, see DefaultTiers) are kept by RunRollups.
+// Without tiers, only the raw points are used.
+func NewInflux(url, token, org, bucket string, tiers ...Tier) *Influx {
+	if len(tiers) == 0 {
+		tiers = []Tier{{Name: "raw"}}
+	}
+	return &Influx{client: influxdb2.NewClient(url, token), org: org, bucket: bucket, tiers: tiers, rolled: map[int]time.Time{}}
+}
+
+// Close the connection to the influx database. Calling it more than once does nothing.
+func (i *Influx) Close() {
+	i.closeOnce.Do(i.client.Close)
 }
 
 func worker(id int, wg *sync.WaitGroup, pointsChan <-chan *write.Point, client influxdb2.Client, org, bucket string) {
@@ -36,45 +132,29 @@ func worker(id int, wg *sync.WaitGroup, pointsChan <-chan *write.Point, client i
 	}
 }
 
-func PopulateDBFromPoints(bucket, org, token, url string, data []Point) {
-	if client == nil {
-		client = influxdb2.NewClient(url, token)
-	}
-
+func (i *Influx) PopulateDBFromPoints(data []Point) {
 	numWorkers := 5
 	pointsChan := make(chan *write.Point, numWorkers)
 	var wg sync.WaitGroup
 
-	for i := 0; i < numWorkers; i++ {
+	for w := 0; w < numWorkers; w++ {
 		wg.Add(1)
-		go worker(i, &wg, pointsChan, client, org, bucket)
+		go worker(w, &wg, pointsChan, i.client, i.org, i.bucket)
 	}
 
 	for _, p := range data {
-		t := p.Timestamp
-		value := p.Value
-		point := influxdb2.NewPointWithMeasurement("energy").
-			AddField("energyConsumption", value).
-			SetTime(t)
-		pointsChan <- point
+		pointsChan <- newEnergyPoint(p)
 	}
 	close(pointsChan) // Close channel to signal workers to exit
 	wg.Wait()
 }
 
-func PopulateDBFromChan(bucket, org, token, url string, pointsChan chan Point, wg *sync.WaitGroup) {
+func (i *Influx) PopulateDBFromChan(pointsChan chan Point, wg *sync.WaitGroup) {
 	defer wg.Done()
-	if client == nil {
-		client = influxdb2.NewClient(url, token)
-	}
-
-	writeAPI := client.WriteAPIBlocking(org, bucket)
+	writeAPI := i.client.WriteAPIBlocking(i.org, i.bucket)
 
 	for p := range pointsChan {
-		t := p.Timestamp
-		value := p.Value
-		point := influxdb2.NewPointWithMeasurement("energy").AddField("energyConsumption", value).SetTime(t)
-		err := writeAPI.WritePoint(context.Background(), point)
+		err := writeAPI.WritePoint(context.Background(), newEnergyPoint(p))
 		if err != nil {
 			fmt.Printf("Problem when writing point : %s", err.Error())
 		}
@@ -82,46 +162,86 @@ func PopulateDBFromChan(bucket, org, token, url string, pointsChan chan Point, w
 
 }
 
-func PopulateFakeDB(bucket, org, token, url string) {
-	if client == nil {
-		client = influxdb2.NewClient(url, token)
-	}
-
+func (i *Influx) PopulateFakeDB() {
 	numWorkers := 5
 	pointsChan := make(chan *write.Point, numWorkers)
 	var wg sync.WaitGroup
 	numPoints := 1200
 
-	for i := 0; i < numWorkers; i++ {
+	for w := 0; w < numWorkers; w++ {
 		wg.Add(1)
-		go worker(i, &wg, pointsChan, client, org, bucket)
+		go worker(w, &wg, pointsChan, i.client, i.org, i.bucket)
 	}
 
 	value := rand.Float64()
-	for i := 0; i < numPoints; i++ {
-		t := time.Now().Add(time.Duration(1*i) * time.Second).UTC()
+	for n := 0; n < numPoints; n++ {
+		t := time.Now().Add(time.Duration(1*n) * time.Second).UTC()
 		value = rand.Float64()*value*2 + 0.2
-		point := influxdb2.NewPointWithMeasurement("energy").
-			AddField("energyConsumption", value).
-			SetTime(t)
-		pointsChan <- point
+		pointsChan <- newEnergyPoint(Point{Timestamp: t, Value: value, Tags: Tags{Source: "fake"}})
 	}
 	close(pointsChan) // Close channel to signal workers to exit
 	wg.Wait()
 }
 
-func GetData(bucket, org, token, url string, start, stop time.Time) []Point {
-	if client == nil {
-		client = influxdb2.NewClient(url, token)
+// Return all the energy points stored between start and stop whose tags match filter.
+//
+// If resolution is not 0, the points may be rollups whose windows are at most resolution wide : the Value of such a
+// point is the sum of the raw values of its window, its Count the number of raw points and its Max and Min their extremes.
+// With a resolution of 0, the raw points are read, or the finest rollups once the raw points of start are deleted.
+// The range is read from the coarsest tier available, and the part this tier doesn't cover yet from the finer ones.
+func (i *Influx) GetData(start, stop time.Time, resolution time.Duration, filter Tags) ([]Point, error) {
+	if stop.Before(start) {
+		return nil, invalidInput("the range ends (%s) before it starts (%s)", stop, start)
+	}
+	t := i.pickTier(start, resolution)
+	if t == 0 {
+		return i.getRawData(start, stop, filter)
+	}
+	until := i.rolledUntil(t)
+	if !until.Before(stop) {
+		return i.getRollupData(t, start, stop, filter)
+	}
+	energy, err := i.getRollupData(t, start, until, filter)
+	if err != nil {
+		return nil, err
 	}
+	rest, err := i.GetData(until, stop, resolution, filter)
+	return append(energy, rest...), err
+}
 
+// Return the rollup points of tier t between start and stop whose tags match filter.
+func (i *Influx) getRollupData(t int, start, stop time.Time, filter Tags) ([]Point, error) {
 	var energy []Point
-	queryAPI := client.QueryAPI(org)
-	startS, stopS := start.UTC().Format(time.RFC3339Nano), stop.UTC().Format(time.RFC3339Nano)
-	query := `from(bucket: "` + bucket + `")
-					|> range(start: ` + startS + `, stop: ` + stopS + `)
-					|> filter(fn: (r) => r._measurement == "energy")
-					|> filter(fn: (r) => r["_field"] == "energyConsumption")`
+	query, params, err := newFluxQuery(i.tierBucket(t), start, stop).
+		measurement("energy").fields("energyConsumption", "count", "max", "min").tags(filter).pivotFields().build()
+	if err != nil {
+		return nil, err
+	}
+	result, err := i.client.QueryAPI(i.org).QueryWithParams(context.Background(), query, params)
+	if err != nil {
+		return nil, unavailable("influx query", err)
+	}
+	for result.Next() {
+		record := result.Record()
+		sum, ok := record.ValueByKey("energyConsumption").(float64)
+		count, ok2 := record.ValueByKey("count").(int64)
+		if ok && ok2 {
+			high, _ := record.ValueByKey("max").(float64)
+			low, _ := record.ValueByKey("min").(float64)
+			energy = append(energy, Point{Timestamp: record.Time(), Value: sum, Count: int(count), Max: high, Min: low, Tags: tagsFromRecord(record.Values())})
+		}
+	}
+	return energy, unavailable("influx query", result.Err())
+}
+
+// Return the raw points stored between start and stop whose tags match filter.
+func (i *Influx) getRawData(start, stop time.Time, filter Tags) ([]Point, error) {
+	var energy []Point
+	queryAPI := i.client.QueryAPI(i.org)
+	query, params, err := newFluxQuery(i.bucket, start, stop).measurement("energy").field("energyConsumption").tags(filter).build()
+	if err != nil {
+		return nil, err
+	}
 
 	dataChan := make(chan Point, 1000)
 	errChan := make(chan error, 1)
@@ -129,16 +249,19 @@ func GetData(bucket, org, token, url string, start, stop time.Time) []Point {
 
 	go func() {
 		defer close(dataChan)
-		result, err := queryAPI.Query(context.Background(), query)
+		result, err := queryAPI.QueryWithParams(context.Background(), query, params)
 		if err != nil {
 			errChan <- err
 			return
 		}
 		for result.Next() {
 			if v, ok := result.Record().Value().(float64); ok {
-				dataChan <- Point{Value: v, Timestamp: result.Record().Time()}
+				dataChan <- Point{Value: v, Timestamp: result.Record().Time(), Tags: tagsFromRecord(result.Record().Values()), Count: 1}
 			}
 		}
+		if result.Err() != nil {
+			errChan <- result.Err()
+		}
 	}()
 
 	wg.Add(1)
@@ -152,60 +275,56 @@ func GetData(bucket, org, token, url string, start, stop time.Time) []Point {
 	wg.Wait()
 	select {
 	case err := <-errChan:
-		log.Println("Query error:", err)
+		return nil, unavailable("influx query", err)
 	default:
 	}
 
-	return energy
+	return energy, nil
 }
 
-func GetTodayHighlights(bucket, org, token, url string) []Point {
-	if client == nil {
-		client = influxdb2.NewClient(url, token)
-	}
-
+func (i *Influx) GetTodayHighlights(filter Tags) ([]Point, error) {
 	var maxMinSum []Point
 	var names = []string{"max", "min", "sum"}
-	queryAPI := client.QueryAPI(org)
+	queryAPI := i.client.QueryAPI(i.org)
 
+	now := time.Now()
 	for _, name := range names {
-		query := `from(bucket: "` + bucket + `")
-		|> range(start: -24h)
-		|> filter(fn: (r) => r._measurement == "energy")
-		|> filter(fn: (r) => r["_field"] == "energyConsumption")
-		|> ` + name + `()`
+		query, params, err := newFluxQuery(i.bucket, now.Add(-24*time.Hour), now).
+			measurement("energy").field("energyConsumption").tags(filter).group().aggregate(name).build()
+		if err != nil {
+			return nil, err
+		}
 
-		result, err := queryAPI.Query(context.Background(), query)
+		result, err := queryAPI.QueryWithParams(context.Background(), query, params)
 		if err != nil {
-			log.Fatal(err)
+			return nil, unavailable("influx query", err)
 		}
 		for result.Next() {
-			maxMinSum = append(maxMinSum, Point{Timestamp: result.Record().Time(), Value: result.Record().Value().(float64)})
+			if v, ok := result.Record().Value().(float64); ok {
+				maxMinSum = append(maxMinSum, Point{Timestamp: result.Record().Time(), Value: v})
+			}
+		}
+		if result.Err() != nil {
+			return nil, unavailable("influx query", result.Err())
 		}
 	}
-	return maxMinSum
+	return maxMinSum, nil
 }
 
-func GetWeeklyMean(bucket, org, token, url string) []Point {
-	if client == nil {
-		client = influxdb2.NewClient(url, token)
-	}
-
+func (i *Influx) GetWeeklyMean(filter Tags) ([]Point, error) {
 	var weeklyMean []Point
-	queryAPI := client.QueryAPI(org)
+	queryAPI := i.client.QueryAPI(i.org)
 
-	query := `import "date"
-
-				from(bucket: "` + bucket + `")
-  					|> range(start: -1y)  
-  					|> filter(fn: (r) => r["_measurement"] == "energy")
-  					|> filter(fn: (r) => r["_field"] == "energyConsumption")
-  					|> aggregateWindow(every: 1w, fn: mean, offset:-3d)
-  					|> yield(name: "mean")`
+	now := time.Now()
+	query, params, err := newFluxQuery(i.bucket, now.AddDate(-1, 0, 0), now).
+		measurement("energy").field("energyConsumption").tags(filter).group().window("1w", "-3d", "mean").build()
+	if err != nil {
+		return nil, err
+	}
 
-	result, err := queryAPI.Query(context.Background(), query)
+	result, err := queryAPI.QueryWithParams(context.Background(), query, params)
 	if err != nil {
-		log.Fatal(err)
+		return nil, unavailable("influx query", err)
 	}
 	for result.Next() {
 		var value float64
@@ -218,5 +337,5 @@ func GetWeeklyMean(bucket, org, token, url string) []Point {
 		weeklyMean = append(weeklyMean, Point{Timestamp: result.Record().Time(), Value: value})
 	}
 
-	return weeklyMean
+	return weeklyMean, unavailable("influx query", result.Err())
 }
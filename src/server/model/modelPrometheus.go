@@ -0,0 +1,432 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const promMetric = "energy_consumption"
+
+// The points received by PopulateDBFromChan are sent by batches of at most promBatchSize,
+// and at least every promFlushInterval while they arrive slowly.
+const (
+	promBatchSize     = 500
+	promFlushInterval = 5 * time.Second
+)
+
+// Prometheus stores the energy points in a prometheus compatible database (prometheus with the remote-write receiver
+// enabled, VictoriaMetrics...). The points are sent with the remote-write protocol, and read back with PromQL
+// over the HTTP API. Each point is a sample of the energy_consumption metric, labelled with its tags.
+// The last points received can also be scraped, see WriteMetrics.
+type Prometheus struct {
+	writeURL string // Remote-write endpoint, for example http://localhost:8428/api/v1/write
+	queryURL string // Root of the HTTP API, for example http://localhost:8428
+	http     *http.Client
+
+	mu    sync.Mutex
+	last  map[Tags]Point   // Last point received of each series
+	total map[Tags]float64 // Sum of the points received of each series since the start
+}
+
+func NewPrometheus(writeURL, queryURL string) *Prometheus {
+	return &Prometheus{writeURL: writeURL, queryURL: strings.TrimSuffix(queryURL, "/"), http: &http.Client{Timeout: time.Minute},
+		last: map[Tags]Point{}, total: map[Tags]float64{}}
+}
+
+func (p *Prometheus) Close() {
+	p.http.CloseIdleConnections()
+}
+
+// Return the labels of a point, sorted by name as remote-write requires.
+func promLabels(tags Tags) [][2]string {
+	labels := [][2]string{{"__name__", promMetric}}
+	for key, value := range tags.Map() {
+		labels = append(labels, [2]string{key, value})
+	}
+	slices.SortFunc(labels, func(a, b [2]string) int { return strings.Compare(a[0], b[0]) })
+	return labels
+}
+
+// Encode the points as a remote-write WriteRequest protobuf message, with one time series per set of tags :
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; } (timestamp in ms)
+func encodeWriteRequest(points []Point) []byte {
+	series := map[Tags][]Point{}
+	var order []Tags
+	for _, point := range points {
+		if _, ok := series[point.Tags]; !ok {
+			order = append(order, point.Tags)
+		}
+		series[point.Tags] = append(series[point.Tags], point)
+	}
+
+	var request []byte
+	for _, tags := range order {
+		var ts []byte
+		for _, label := range promLabels(tags) {
+			var l []byte
+			l = protowire.AppendTag(l, 1, protowire.BytesType)
+			l = protowire.AppendString(l, label[0])
+			l = protowire.AppendTag(l, 2, protowire.BytesType)
+			l = protowire.AppendString(l, label[1])
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, l)
+		}
+		samples := series[tags]
+		slices.SortFunc(samples, func(a, b Point) int { return a.Timestamp.Compare(b.Timestamp) })
+		for _, point := range samples {
+			var s []byte
+			s = protowire.AppendTag(s, 1, protowire.Fixed64Type)
+			s = protowire.AppendFixed64(s, math.Float64bits(point.Value))
+			s = protowire.AppendTag(s, 2, protowire.VarintType)
+			s = protowire.AppendVarint(s, uint64(point.Timestamp.UnixMilli()))
+			ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, s)
+		}
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, ts)
+	}
+	return request
+}
+
+// Send the points to the remote-write endpoint.
+func (p *Prometheus) write(points []Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodPost, p.writeURL, bytes.NewReader(snappy.Encode(nil, encodeWriteRequest(points))))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote-write returned %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+func (p *Prometheus) PopulateDBFromPoints(data []Point) {
+	p.record(data)
+	if err := p.write(data); err != nil {
+		log.Printf("Error writing to prometheus: %v\n", err)
+	}
+}
+
+// Send the points of the channel by batches (see promBatchSize), until it is closed.
+func (p *Prometheus) PopulateDBFromChan(pointsChan chan Point, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(promFlushInterval)
+	defer ticker.Stop()
+	batch := make([]Point, 0, promBatchSize)
+	flush := func() {
+		p.record(batch)
+		if err := p.write(batch); err != nil {
+			fmt.Printf("Problem when writing %d points : %s", len(batch), err.Error())
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case point, ok := <-pointsChan:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, point)
+			if len(batch) >= promBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Keep the last point and the running sum of each series, for WriteMetrics.
+func (p *Prometheus) record(points []Point) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, point := range points {
+		if last, ok := p.last[point.Tags]; !ok || !point.Timestamp.Before(last.Timestamp) {
+			p.last[point.Tags] = point
+		}
+		p.total[point.Tags] += point.Value
+	}
+}
+
+// Escape a label value of the text exposition format.
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Write the points received since the start in the prometheus text exposition format, so that a prometheus
+// can also scrape them : the last point of each series (energy_consumption_last, with its time) and their sum
+// (energy_consumption_received_total), labelled with their tags.
+func (p *Prometheus) WriteMetrics(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	labels := map[Tags]string{}
+	var order []Tags
+	for tags := range p.last {
+		var pairs []string
+		for _, label := range promLabels(tags)[1:] {
+			pairs = append(pairs, label[0]+`="`+promEscaper.Replace(label[1])+`"`)
+		}
+		labels[tags] = "{" + strings.Join(pairs, ",") + "}"
+		order = append(order, tags)
+	}
+	slices.SortFunc(order, func(a, b Tags) int { return strings.Compare(labels[a], labels[b]) })
+
+	var b strings.Builder
+	b.WriteString("# HELP " + promMetric + "_last Last energy point received, in its unit.\n")
+	b.WriteString("# TYPE " + promMetric + "_last gauge\n")
+	for _, tags := range order {
+		fmt.Fprintf(&b, "%s_last%s %s %d\n", promMetric, labels[tags],
+			strconv.FormatFloat(p.last[tags].Value, 'g', -1, 64), p.last[tags].Timestamp.UnixMilli())
+	}
+	b.WriteString("# HELP " + promMetric + "_received_total Sum of the energy points received since the server started, in their unit.\n")
+	b.WriteString("# TYPE " + promMetric + "_received_total counter\n")
+	for _, tags := range order {
+		fmt.Fprintf(&b, "%s_received_total%s %s\n", promMetric, labels[tags], strconv.FormatFloat(p.total[tags], 'g', -1, 64))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (p *Prometheus) PopulateFakeDB() {
+	numPoints := 1200
+	points := make([]Point, 0, numPoints)
+	value := rand.Float64()
+	for n := 0; n < numPoints; n++ {
+		t := time.Now().Add(time.Duration(1*n) * time.Second).UTC()
+		value = rand.Float64()*value*2 + 0.2
+		points = append(points, Point{Timestamp: t, Value: value, Tags: Tags{Source: "fake"}})
+	}
+	p.PopulateDBFromPoints(points)
+}
+
+// Return the PromQL selector of the energy samples matching filter. The label values are quoted,
+// so they cannot change the meaning of the query.
+func promSelector(filter Tags) string {
+	matchers := []string{}
+	for _, key := range tagKeys {
+		if v, ok := filter.Map()[key]; ok {
+			matchers = append(matchers, key+"="+strconv.Quote(v))
+		}
+	}
+	return promMetric + "{" + strings.Join(matchers, ",") + "}"
+}
+
+// Return a PromQL duration of at least one second covering d.
+func promDuration(d time.Duration) string {
+	return strconv.FormatInt(max(int64(math.Ceil(d.Seconds())), 1), 10) + "s"
+}
+
+type promSample [2]interface{} // [unix time in seconds, "value"]
+
+func (s promSample) parse() (time.Time, float64, bool) {
+	ts, ok := s[0].(float64)
+	str, ok2 := s[1].(string)
+	if !ok || !ok2 {
+		return time.Time{}, 0, false
+	}
+	v, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return time.UnixMilli(int64(math.Round(ts * 1000))).UTC(), v, true
+}
+
+type promResult struct {
+	Metric map[string]string `json:"metric"`
+	Values []promSample      `json:"values"` // Matrix results
+	Value  promSample        `json:"value"`  // Vector results
+}
+
+// Run a query on the HTTP API (path is /api/v1/query or /api/v1/query_range) and return its results.
+func (p *Prometheus) query(path string, params url.Values) ([]promResult, error) {
+	resp, err := p.http.PostForm(p.queryURL+path, params)
+	if err != nil {
+		return nil, unavailable("prometheus query", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Status    string `json:"status"`
+		ErrorType string `json:"errorType"`
+		Error     string `json:"error"`
+		Data      struct {
+			Result []promResult `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, unavailable("prometheus returned "+resp.Status, err)
+	}
+	if body.Status != "success" {
+		if body.ErrorType == "bad_data" {
+			return nil, invalidInput("prometheus query failed: %s", body.Error)
+		}
+		return nil, fmt.Errorf("%w: prometheus query failed: %s", ErrUnavailable, body.Error)
+	}
+	return body.Data.Result, nil
+}
+
+func tagsFromLabels(labels map[string]string) Tags {
+	return Tags{Host: labels["host"], Source: labels["source"], Domain: labels["domain"], Unit: labels["unit"], Process: labels["process"]}
+}
+
+// Return all the energy points stored between start and stop whose tags match filter.
+//
+// If resolution is at least one minute, the points are computed by prometheus over windows of resolution
+// (sum_over_time and count_over_time) : the Value of such a point is the sum of the raw values of its window
+// and its Count the number of raw points, like the rollups of Influx.
+func (p *Prometheus) GetData(start, stop time.Time, resolution time.Duration, filter Tags) ([]Point, error) {
+	if stop.Before(start) {
+		return nil, invalidInput("the range ends (%s) before it starts (%s)", stop, start)
+	}
+	resolution = resolution.Truncate(time.Second)
+	if resolution < time.Minute || stop.Sub(start) < resolution {
+		return p.getRawData(start, stop, filter)
+	}
+
+	step := promDuration(resolution)
+	windows := int(stop.Sub(start) / resolution)
+	end := start.Add(time.Duration(windows) * resolution)
+	params := func(query string) url.Values {
+		return url.Values{
+			"query": {query + "[" + step + "])"},
+			"start": {strconv.FormatInt(start.Add(resolution).Unix(), 10)},
+			"end":   {strconv.FormatInt(end.Unix(), 10)},
+			"step":  {step},
+		}
+	}
+	sums, err := p.query("/api/v1/query_range", params("sum_over_time("+promSelector(filter)))
+	if err != nil {
+		return nil, err
+	}
+	counts, err := p.query("/api/v1/query_range", params("count_over_time("+promSelector(filter)))
+	if err != nil {
+		return nil, err
+	}
+
+	// The results are matched by series and time. Prometheus timestamps a window with its end,
+	// the points are timestamped with its start like the influx rollups.
+	type key struct {
+		tags Tags
+		t    time.Time
+	}
+	nbr := map[key]int{}
+	for _, series := range counts {
+		for _, sample := range series.Values {
+			if t, v, ok := sample.parse(); ok {
+				nbr[key{tagsFromLabels(series.Metric), t}] = int(v)
+			}
+		}
+	}
+	var energy []Point
+	for _, series := range sums {
+		tags := tagsFromLabels(series.Metric)
+		for _, sample := range series.Values {
+			if t, v, ok := sample.parse(); ok && nbr[key{tags, t}] > 0 {
+				energy = append(energy, Point{Timestamp: t.Add(-resolution), Value: v, Tags: tags, Count: nbr[key{tags, t}]})
+			}
+		}
+	}
+	rest, err := p.getRawData(end, stop, filter)
+	return append(energy, rest...), err
+}
+
+// Return the raw samples stored between start and stop whose tags match filter.
+func (p *Prometheus) getRawData(start, stop time.Time, filter Tags) ([]Point, error) {
+	var energy []Point
+	if !start.Before(stop) {
+		return energy, nil
+	}
+	results, err := p.query("/api/v1/query", url.Values{
+		"query": {promSelector(filter) + "[" + promDuration(stop.Sub(start)) + "]"},
+		"time":  {strconv.FormatFloat(float64(stop.UnixMilli())/1000, 'f', 3, 64)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, series := range results {
+		tags := tagsFromLabels(series.Metric)
+		for _, sample := range series.Values {
+			if t, v, ok := sample.parse(); ok && !t.Before(start) {
+				energy = append(energy, Point{Timestamp: t, Value: v, Tags: tags, Count: 1})
+			}
+		}
+	}
+	return energy, nil
+}
+
+// Return the maximum, minimum and sum of the energy points of the last 24h. Unlike influx, prometheus
+// doesn't tell when the maximum and minimum happened, so all the points are timestamped now.
+func (p *Prometheus) GetTodayHighlights(filter Tags) ([]Point, error) {
+	var maxMinSum []Point
+	now := time.Now().UTC()
+	for _, query := range []string{"max(max_over_time(%s[24h]))", "min(min_over_time(%s[24h]))", "sum(sum_over_time(%s[24h]))"} {
+		results, err := p.query("/api/v1/query", url.Values{
+			"query": {fmt.Sprintf(query, promSelector(filter))},
+			"time":  {strconv.FormatInt(now.Unix(), 10)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			if _, v, ok := result.Value.parse(); ok {
+				maxMinSum = append(maxMinSum, Point{Timestamp: now, Value: v})
+			}
+		}
+	}
+	return maxMinSum, nil
+}
+
+// Return the mean of the energy points of each week of the last year.
+func (p *Prometheus) GetWeeklyMean(filter Tags) ([]Point, error) {
+	var weeklyMean []Point
+	now := time.Now().UTC()
+	selector := promSelector(filter)
+	results, err := p.query("/api/v1/query_range", url.Values{
+		"query": {"sum(sum_over_time(" + selector + "[1w])) / sum(count_over_time(" + selector + "[1w]))"},
+		"start": {strconv.FormatInt(now.AddDate(-1, 0, 0).Unix(), 10)},
+		"end":   {strconv.FormatInt(now.Unix(), 10)},
+		"step":  {"1w"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range results {
+		for _, sample := range result.Values {
+			if t, v, ok := sample.parse(); ok {
+				weeklyMean = append(weeklyMean, Point{Timestamp: t, Value: v})
+			}
+		}
+	}
+	return weeklyMean, nil
+}
@@ -0,0 +1,280 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// A time series of a remote-write request, as decoded by the stand-in server.
+type writtenSeries struct {
+	labels  [][2]string
+	samples []Point // Only Timestamp and Value
+}
+
+// Decode a WriteRequest message, see encodeWriteRequest for its layout. Every field is read with its number checked.
+func decodeWriteRequest(t *testing.T, b []byte) []writtenSeries {
+	t.Helper()
+	// Return the bytes of each field of message b, by field number
+	fields := func(b []byte) map[protowire.Number][][]byte {
+		m := map[protowire.Number][][]byte{}
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatalf("bad tag: %v", protowire.ParseError(n))
+			}
+			b = b[n:]
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				t.Fatalf("bad field %d: %v", num, protowire.ParseError(n))
+			}
+			value := b[:n]
+			if typ == protowire.BytesType {
+				value, _ = protowire.ConsumeBytes(value)
+			}
+			m[num] = append(m[num], value)
+			b = b[n:]
+		}
+		return m
+	}
+	var series []writtenSeries
+	for _, ts := range fields(b)[1] {
+		var s writtenSeries
+		tsFields := fields(ts)
+		for _, label := range tsFields[1] {
+			l := fields(label)
+			s.labels = append(s.labels, [2]string{string(l[1][0]), string(l[2][0])})
+		}
+		for _, sample := range tsFields[2] {
+			f := fields(sample)
+			bits, _ := protowire.ConsumeFixed64(f[1][0])
+			ms, _ := protowire.ConsumeVarint(f[2][0])
+			s.samples = append(s.samples, Point{Timestamp: time.UnixMilli(int64(ms)).UTC(), Value: math.Float64frombits(bits)})
+		}
+		series = append(series, s)
+	}
+	return series
+}
+
+// A stand-in for a prometheus server : it keeps the remote-write requests it receives, and answers the queries
+// with the canned json of the first of answers whose key (answer[0]) is in the PromQL query.
+type promServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests [][]writtenSeries
+	queries  []map[string]string // Parameters of the queries received
+	answers  [][2]string
+}
+
+func newPromServer(t *testing.T, answers [][2]string) *promServer {
+	s := &promServer{answers: answers}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/write":
+			if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+				t.Errorf("remote-write headers %v", r.Header)
+			}
+			compressed, _ := io.ReadAll(r.Body)
+			body, err := snappy.Decode(nil, compressed)
+			if err != nil {
+				t.Errorf("remote-write body is not snappy: %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.mu.Lock()
+			s.requests = append(s.requests, decodeWriteRequest(t, body))
+			s.mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		case "/api/v1/query", "/api/v1/query_range":
+			r.ParseForm()
+			params := map[string]string{"path": r.URL.Path}
+			for key := range r.Form {
+				params[key] = r.Form.Get(key)
+			}
+			s.mu.Lock()
+			s.queries = append(s.queries, params)
+			s.mu.Unlock()
+			for _, answer := range s.answers {
+				if strings.Contains(params["query"], answer[0]) {
+					io.WriteString(w, answer[1])
+					return
+				}
+			}
+			t.Errorf("unexpected query %v", params)
+			http.Error(w, "unexpected query", http.StatusBadRequest)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestPrometheusWriteBatches(t *testing.T) {
+	server := newPromServer(t, nil)
+	p := NewPrometheus(server.URL+"/api/v1/write", server.URL)
+	defer p.Close()
+
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	rapl := Tags{Host: "node1", Source: "rapl", Domain: "package-0", Unit: "J"}
+	demeter := Tags{Host: "node1", Source: "demeter", Unit: "mWh"}
+	pointsChan := make(chan Point)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.PopulateDBFromChan(pointsChan, &wg)
+	for i := range 1200 {
+		tags := rapl
+		if i%3 == 0 {
+			tags = demeter
+		}
+		pointsChan <- Point{Timestamp: start.Add(time.Duration(i) * time.Second), Value: float64(i) / 4, Tags: tags}
+	}
+	close(pointsChan)
+	wg.Wait()
+
+	// 1200 points are sent in 3 requests, not one per point
+	if len(server.requests) != 3 {
+		t.Fatalf("%d remote-write requests, want 3", len(server.requests))
+	}
+	wantLabels := map[string][][2]string{
+		"rapl":    {{"__name__", "energy_consumption"}, {"domain", "package-0"}, {"host", "node1"}, {"source", "rapl"}, {"unit", "J"}},
+		"demeter": {{"__name__", "energy_consumption"}, {"host", "node1"}, {"source", "demeter"}, {"unit", "mWh"}},
+	}
+	received := 0
+	for r, request := range server.requests {
+		samples := 0
+		for _, series := range request {
+			var source string
+			for _, label := range series.labels {
+				if label[0] == "source" {
+					source = label[1]
+				}
+			}
+			if !reflect.DeepEqual(series.labels, wantLabels[source]) {
+				t.Errorf("request %d: labels %v, want %v", r, series.labels, wantLabels[source])
+			}
+			for i, sample := range series.samples {
+				n := int(sample.Timestamp.Sub(start) / time.Second)
+				if sample.Value != float64(n)/4 || (n%3 == 0) != (source == "demeter") {
+					t.Errorf("request %d: sample %v of %s, want the value %g", r, sample, source, float64(n)/4)
+				}
+				if i > 0 && !series.samples[i-1].Timestamp.Before(sample.Timestamp) {
+					t.Errorf("request %d: samples of %s not sorted by time", r, source)
+				}
+			}
+			samples += len(series.samples)
+		}
+		if want := min(promBatchSize, 1200-received); samples != want {
+			t.Errorf("request %d: %d samples, want %d", r, samples, want)
+		}
+		received += samples
+	}
+}
+
+func TestPrometheusGetData(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) int64 { return start.Add(d).Unix() }
+	server := newPromServer(t, [][2]string{
+		// Windows of a minute, timestamped with their end : 6 J from 3 points, then 9 J from 3 points, then nothing
+		{"sum_over_time", fmt.Sprintf(`{"status": "success", "data": {"resultType": "matrix", "result": [
+			{"metric": {"host": "node1", "unit": "J"}, "values": [[%d, "6"], [%d, "9"], [%d, "0"]]}]}}`,
+			at(time.Minute), at(2*time.Minute), at(3*time.Minute))},
+		{"count_over_time", fmt.Sprintf(`{"status": "success", "data": {"resultType": "matrix", "result": [
+			{"metric": {"host": "node1", "unit": "J"}, "values": [[%d, "3"], [%d, "3"]]}]}}`,
+			at(time.Minute), at(2*time.Minute))},
+		// The raw points of the range, and one just before it
+		{`energy_consumption{host="node1"}[`, fmt.Sprintf(`{"status": "success", "data": {"resultType": "matrix", "result": [
+			{"metric": {"__name__": "energy_consumption", "host": "node1", "source": "rapl", "unit": "J"},
+			"values": [[%d.5, "1.5"], [%d, "2"], [%d.25, "2.5"]]}]}}`, at(-time.Second), at(0), at(10*time.Second))},
+		{`process="x\"}"`, `{"status": "error", "errorType": "bad_data", "error": "parse error"}`},
+	})
+	p := NewPrometheus(server.URL+"/api/v1/write", server.URL+"/")
+	defer p.Close()
+	filter := Tags{Host: "node1"}
+
+	cases := []struct {
+		name       string
+		stop       time.Time
+		resolution time.Duration
+		want       []Point
+		query      map[string]string
+	}{
+		{
+			name: "rollups", stop: start.Add(3 * time.Minute), resolution: time.Minute,
+			want: []Point{
+				{Timestamp: start, Value: 6, Tags: Tags{Host: "node1", Unit: "J"}, Count: 3},
+				{Timestamp: start.Add(time.Minute), Value: 9, Tags: Tags{Host: "node1", Unit: "J"}, Count: 3},
+			},
+			query: map[string]string{"path": "/api/v1/query_range", "query": `count_over_time(energy_consumption{host="node1"}[60s])`,
+				"start": fmt.Sprint(at(time.Minute)), "end": fmt.Sprint(at(3 * time.Minute)), "step": "60s"},
+		},
+		{
+			name: "raw points", stop: start.Add(time.Minute),
+			want: []Point{
+				{Timestamp: start, Value: 2, Tags: Tags{Host: "node1", Source: "rapl", Unit: "J"}, Count: 1},
+				{Timestamp: start.Add(10*time.Second + 250*time.Millisecond), Value: 2.5, Tags: Tags{Host: "node1", Source: "rapl", Unit: "J"}, Count: 1},
+			},
+			query: map[string]string{"path": "/api/v1/query", "query": `energy_consumption{host="node1"}[60s]`,
+				"time": fmt.Sprintf("%d.000", at(time.Minute))},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			points, err := p.GetData(start, tc.stop, tc.resolution, filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(points, tc.want) {
+				t.Errorf("got %+v\nwant %+v", points, tc.want)
+			}
+			if last := server.queries[len(server.queries)-1]; !reflect.DeepEqual(last, tc.query) {
+				t.Errorf("last query %v, want %v", last, tc.query)
+			}
+		})
+	}
+
+	// The label values are quoted, and the bad queries are the fault of the caller
+	if _, err := p.GetData(start, start.Add(time.Minute), 0, Tags{Process: `x"}`}); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("error %v for a bad query, want ErrInvalidInput", err)
+	}
+}
+
+func TestPrometheusWriteMetrics(t *testing.T) {
+	server := newPromServer(t, nil)
+	p := NewPrometheus(server.URL+"/api/v1/write", server.URL)
+	defer p.Close()
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	p.PopulateDBFromPoints([]Point{
+		{Timestamp: start.Add(time.Second), Value: 2, Tags: Tags{Host: "node1", Unit: "J"}},
+		{Timestamp: start, Value: 1.5, Tags: Tags{Host: "node1", Unit: "J"}},
+		{Timestamp: start, Value: 4, Tags: Tags{Host: "node1", Process: `a "b"\c`, Unit: "J"}},
+	})
+
+	var b strings.Builder
+	if err := p.WriteMetrics(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP energy_consumption_last Last energy point received, in its unit.
+# TYPE energy_consumption_last gauge
+energy_consumption_last{host="node1",process="a \"b\"\\c",unit="J"} 4 1714521600000
+energy_consumption_last{host="node1",unit="J"} 2 1714521601000
+# HELP energy_consumption_received_total Sum of the energy points received since the server started, in their unit.
+# TYPE energy_consumption_received_total counter
+energy_consumption_received_total{host="node1",process="a \"b\"\\c",unit="J"} 4
+energy_consumption_received_total{host="node1",unit="J"} 3.5
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
@@ -0,0 +1,100 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Record that the client of the session is still alive. The sessions whose client sent a heartbeat once
+// are closed by DisconnectIdleSessions if it stops sending them. If the session is not open, the error wraps ErrNotFound.
+func (s *SQLStore) SessionHeartbeat(sessionID int) error {
+	res, err := s.db.Exec("update sessions set last_seen = $1 where id = $2 and stop is null", time.Now().UTC(), sessionID)
+	if err != nil {
+		return unavailable("session heartbeat", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFound("no open session with id %d", sessionID)
+	}
+	return nil
+}
+
+// Same as SessionHeartbeat, for all the open sessions of the user.
+func (s *SQLStore) UserHeartbeat(id int) error {
+	res, err := s.db.Exec("update sessions set last_seen = $1 where userID = $2 and stop is null", time.Now().UTC(), id)
+	if err != nil {
+		return unavailable("user heartbeat", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFound("user %d has no open session", id)
+	}
+	return nil
+}
+
+// Close the sessions whose client sent no heartbeat for longer than timeout, at the time of their last heartbeat,
+// like CloseSession would have then. The sessions that never had a heartbeat are left alone.
+// Return the ids of the sessions closed.
+func (s *SQLStore) DisconnectIdleSessions(timeout time.Duration, actor string) ([]int, error) {
+	if timeout <= 0 {
+		return nil, invalidInput("the idle timeout must be positive, not %s", timeout)
+	}
+	idle := []int{}
+	candidates, err := s.idleSessions(time.Now().Add(-timeout))
+	if err != nil {
+		return idle, unavailable("find idle sessions", err)
+	}
+	for _, sessionID := range candidates {
+		disconnected := false
+		err := s.withTx(func(tx *sql.Tx) error {
+			// The client may have sent a heartbeat since
+			userID, lastSeen, ok, err := s.lastSeen(tx, sessionID)
+			if err != nil || !ok || time.Since(lastSeen) <= timeout {
+				return err
+			}
+			disconnected = true
+			return s.closeSessionsAt(tx, userID, []int{sessionID}, lastSeen, actor)
+		})
+		if err != nil {
+			return idle, unavailable("disconnect idle session", err)
+		}
+		if disconnected {
+			idle = append(idle, sessionID)
+		}
+	}
+	return idle, nil
+}
+
+// Return the open sessions whose last heartbeat was before deadline, compared here since sqlite stores the times as text.
+func (s *SQLStore) idleSessions(deadline time.Time) ([]int, error) {
+	rows, err := s.db.Query("select id, last_seen from sessions where stop is null and last_seen is not null order by id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		var lastSeen time.Time
+		if err := rows.Scan(&id, &lastSeen); err != nil {
+			return nil, err
+		}
+		if lastSeen.Before(deadline) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, rows.Err()
+}
+
+// Return the user and the last heartbeat of the session inside tx, ok is false if it is closed or never had one.
+func (s *SQLStore) lastSeen(tx *sql.Tx, sessionID int) (userID int, t time.Time, ok bool, err error) {
+	// Lock the open time-range first, like every change of the sessions
+	if _, err = tx.Exec("select id from plages where stop is null" + s.dialect.forUpdate); err != nil {
+		return 0, t, false, err
+	}
+	var lastSeen sql.NullTime
+	err = tx.QueryRow("select userID, last_seen from sessions where id = $1 and stop is null", sessionID).Scan(&userID, &lastSeen)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, t, false, nil
+	}
+	return userID, lastSeen.Time.UTC(), lastSeen.Valid, err
+}
@@ -0,0 +1,40 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Run fn in a transaction and remember the id it returns under key, unless key was already used for this endpoint :
+// the id remembered is returned then and fn is not run. The key is stored in the same transaction
+// as the change, so a request sent again after a failure is never done twice. An empty key always runs fn.
+func (s *SQLStore) withRequestKey(key, endpoint string, fn func(tx *sql.Tx) (int, error)) (int, error) {
+	if len(key) > 255 {
+		return 0, invalidInput("request key longer than 255 characters")
+	}
+	var id int
+	err := s.withTx(func(tx *sql.Tx) error {
+		if key != "" {
+			var usedFor string
+			err := tx.QueryRow("select endpoint, resultID from request_keys where request_key = $1", key).Scan(&usedFor, &id)
+			if err == nil {
+				if usedFor != endpoint {
+					return invalidInput("the request key %q was already used for %s", key, usedFor)
+				}
+				return nil
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
+		var err error
+		if id, err = fn(tx); err != nil || key == "" {
+			return err
+		}
+		_, err = tx.Exec("insert into request_keys (request_key, endpoint, resultID, created_at) values ($1, $2, $3, $4)",
+			key, endpoint, id, time.Now().UTC())
+		return err
+	})
+	return id, err
+}
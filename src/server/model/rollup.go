@@ -0,0 +1,218 @@
+package model
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+)
+
+// A Tier is one level of resolution of the energy data. The first tier holds the raw points in the main bucket,
+// the next ones hold the rollups computed by RunRollups, each in its own bucket named <bucket>_<tier name>.
+// A rollup point stores the sum of the raw values of its window in the energyConsumption field,
+// along with the max, min and count fields.
+type Tier struct {
+	Name      string
+	Every     time.Duration // Width of the rollup windows, 0 for the raw points
+	Retention time.Duration // How long the points are kept by influx, 0 to keep them forever
+}
+
+// Return the usual tiers : raw points, 1 minute, 1 hour and 1 day rollups, with their retention in days (0 for forever).
+func DefaultTiers(rawDays, minuteDays, hourDays, dayDays int) []Tier {
+	days := func(n int) time.Duration { return time.Duration(n) * 24 * time.Hour }
+	return []Tier{
+		{Name: "raw", Retention: days(rawDays)},
+		{Name: "1m", Every: time.Minute, Retention: days(minuteDays)},
+		{Name: "1h", Every: time.Hour, Retention: days(hourDays)},
+		{Name: "1d", Every: 24 * time.Hour, Retention: days(dayDays)},
+	}
+}
+
+// For each field of a rollup point : the aggregate to apply, and the field it is computed from
+// when the source is the raw points or another rollup.
+var rollupFields = []struct {
+	name, fn, fromRaw, fromRollup string
+}{
+	{"energyConsumption", "sum", "energyConsumption", "energyConsumption"},
+	{"max", "max", "energyConsumption", "max"},
+	{"min", "min", "energyConsumption", "min"},
+	{"count", "count", "energyConsumption", "count"},
+}
+
+func (i *Influx) tierBucket(t int) string {
+	if t == 0 {
+		return i.bucket
+	}
+	return i.bucket + "_" + i.tiers[t].Name
+}
+
+// Create the bucket of every tier if it does not exist yet, and set the retention of the rollup buckets to the one
+// of their tier. The retention of the raw bucket, which holds the history of older versions, is only changed
+// if the raw tier has one (RAW_RETENTION_DAYS), since it deletes the points older than it.
+func (i *Influx) EnsureTierBuckets(ctx context.Context) error {
+	org, err := i.client.OrganizationsAPI().FindOrganizationByName(ctx, i.org)
+	if err != nil {
+		return err
+	}
+	bucketsAPI := i.client.BucketsAPI()
+	for t, tier := range i.tiers {
+		rule := domain.RetentionRule{EverySeconds: int64(tier.Retention / time.Second)}
+		bucket, err := bucketsAPI.FindBucketByName(ctx, i.tierBucket(t))
+		if err != nil {
+			if _, err := bucketsAPI.CreateBucketWithName(ctx, org, i.tierBucket(t), rule); err != nil {
+				return err
+			}
+			continue
+		}
+		if t == 0 && tier.Retention == 0 {
+			continue
+		}
+		if len(bucket.RetentionRules) != 1 || bucket.RetentionRules[0].EverySeconds != rule.EverySeconds {
+			bucket.RetentionRules = domain.RetentionRules{rule}
+			if _, err := bucketsAPI.UpdateBucket(ctx, bucket); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Return the time until which the tier t contains all its windows. The raw points are always complete.
+func (i *Influx) rolledUntil(t int) time.Time {
+	if t == 0 {
+		return time.Now()
+	}
+	i.rollupMu.Lock()
+	defer i.rollupMu.Unlock()
+	return i.rolled[t]
+}
+
+// Return the end of the last window stored in the bucket of tier t, or the oldest time
+// still kept by the source tier if the bucket is empty.
+func (i *Influx) lastRollup(ctx context.Context, t int) time.Time {
+	now := time.Now()
+	oldest := now.AddDate(-1, 0, 0)
+	if retention := i.tiers[t-1].Retention; retention > 0 {
+		oldest = now.Add(-retention)
+	}
+
+	query, params, err := newFluxQuery(i.tierBucket(t), oldest, now).
+		measurement("energy").field("count").latest().build()
+	if err != nil {
+		log.Println("Rollup error:", err)
+		return oldest.Truncate(i.tiers[t].Every)
+	}
+	result, err := i.client.QueryAPI(i.org).QueryWithParams(ctx, query, params)
+	if err != nil {
+		log.Println("Rollup error:", err)
+		return oldest.Truncate(i.tiers[t].Every)
+	}
+	last := oldest.Truncate(i.tiers[t].Every)
+	for result.Next() {
+		last = result.Record().Time().Add(i.tiers[t].Every)
+	}
+	return last
+}
+
+// Compute the windows of tier t between from and to (both aligned on the windows of the tier)
+// from the points of the tier just below.
+func (i *Influx) rollup(ctx context.Context, t int, from, to time.Time) error {
+	queryAPI := i.client.QueryAPI(i.org)
+	for _, f := range rollupFields {
+		source := f.fromRollup
+		if t == 1 {
+			source = f.fromRaw
+		}
+		fn := f.fn
+		if t > 1 && f.name == "count" {
+			fn = "sum" // The counts of the windows below are added up
+		}
+		query, params, err := newFluxQuery(i.tierBucket(t-1), from, to).
+			measurement("energy").field(source).rollupWindow(i.tiers[t].Every, fn).
+			setField(f.name).to(i.tierBucket(t)).build()
+		if err != nil {
+			return err
+		}
+		result, err := queryAPI.QueryWithParams(ctx, query, params)
+		if err != nil {
+			return err
+		}
+		for result.Next() {
+			// The rows are written by to(), there is nothing to read
+		}
+		if result.Err() != nil {
+			return result.Err()
+		}
+	}
+	return nil
+}
+
+// Keep the rollup tiers up to date : every interval, compute the windows that ended since the last run,
+// starting from the finest tier. Each tier only uses windows of the tier below that are complete,
+// and a window is computed one window late so that the points arriving with a small delay are counted.
+// It stops when ctx is cancelled.
+func (i *Influx) RunRollups(ctx context.Context, interval time.Duration) {
+	if len(i.tiers) < 2 {
+		return
+	}
+	for t := 1; t < len(i.tiers); t++ {
+		last := i.lastRollup(ctx, t)
+		i.rollupMu.Lock()
+		i.rolled[t] = last
+		i.rollupMu.Unlock()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for t := 1; t < len(i.tiers); t++ {
+			every := i.tiers[t].Every
+			from := i.rolledUntil(t)
+			to := time.Now().Truncate(every).Add(-every)
+			if source := i.rolledUntil(t - 1).Truncate(every); source.Before(to) {
+				to = source
+			}
+			if !from.Before(to) {
+				continue
+			}
+			if err := i.rollup(ctx, t, from, to); err != nil {
+				log.Printf("Rollup error on tier %s: %v\n", i.tiers[t].Name, err)
+				continue
+			}
+			i.rollupMu.Lock()
+			i.rolled[t] = to
+			i.rollupMu.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Return the index of the coarsest tier whose windows are not larger than resolution,
+// that still keeps the points at start, and that has been computed at least until after start.
+// If the raw points of start are deleted already, the finest tier that still keeps them is used whatever resolution is.
+func (i *Influx) pickTier(start time.Time, resolution time.Duration) int {
+	now := time.Now()
+	keeps := func(t int) bool {
+		retention := i.tiers[t].Retention
+		return (retention == 0 || !start.Before(now.Add(-retention))) && (t == 0 || start.Before(i.rolledUntil(t)))
+	}
+	for t := len(i.tiers) - 1; t > 0; t-- {
+		if i.tiers[t].Every <= resolution && keeps(t) {
+			return t
+		}
+	}
+	if !keeps(0) {
+		for t := 1; t < len(i.tiers); t++ {
+			if keeps(t) {
+				return t
+			}
+		}
+	}
+	return 0
+}
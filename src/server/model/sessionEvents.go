@@ -0,0 +1,362 @@
+package model
+
+import (
+	"database/sql"
+	"slices"
+	"time"
+)
+
+// The kinds of session events.
+const (
+	EventConnect    = "connect"    // The session opened
+	EventDisconnect = "disconnect" // The session closed
+)
+
+// A SessionEvent is the opening or the closing of a session. The events are the record of the sessions :
+// they are only appended, and the time-ranges and links are derived from them (see RebuildTimeRanges).
+type SessionEvent struct {
+	ID         int       `json:"id"` // In the order the events were recorded, not the order they happened
+	SessionID  int       `json:"sessionID"`
+	Kind       string    `json:"kind"`
+	At         time.Time `json:"at"`         // When it happened
+	RecordedAt time.Time `json:"recordedAt"` // When the server received it, later than At for the late events
+	Source     string    `json:"source"`     // Who sent it
+}
+
+// Record the event of the session inside tx. The time-ranges must be derived again from at afterwards.
+func appendEvent(tx *sql.Tx, sessionID int, kind string, at time.Time, source string) error {
+	_, err := tx.Exec("insert into session_events (sessionID, kind, at, recorded_at, source) values ($1, $2, $3, $4, $5)",
+		sessionID, kind, at.UTC(), time.Now().UTC(), source)
+	return err
+}
+
+// Return the time of an event sent with the time at, now if it is the zero time.
+// If it is in the future, the error wraps ErrInvalidInput.
+func eventTime(at time.Time) (time.Time, error) {
+	now := time.Now().UTC()
+	if at.IsZero() {
+		return now, nil
+	}
+	if at.After(now) {
+		return at, invalidInput("the time %s is in the future", at.Format(time.RFC3339))
+	}
+	return at.UTC(), nil
+}
+
+// Return at most limit events recorded after the event with id after, in the order they were recorded.
+// Reading them again from the last id seen follows the stream of the events.
+func (s *SQLStore) GetSessionEvents(after, limit int) ([]SessionEvent, error) {
+	events := []SessionEvent{}
+	rows, err := s.db.Query(`select id, sessionID, kind, at, recorded_at, source from session_events
+		where id > $1 order by id limit $2`, after, limit)
+	if err != nil {
+		return nil, unavailable("get session events", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e SessionEvent
+		if err := rows.Scan(&e.ID, &e.SessionID, &e.Kind, &e.At, &e.RecordedAt, &e.Source); err != nil {
+			return nil, unavailable("get session events", err)
+		}
+		events = append(events, e)
+	}
+	return events, unavailable("get session events", rows.Err())
+}
+
+// Derive all the time-ranges and links again from the events, as if they had been recorded in the order they happened.
+// actor is who asked for it, kept in the audit log with the number of time-ranges before and after.
+func (s *SQLStore) RebuildTimeRanges(actor string) error {
+	err := s.withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("select id from plages where stop is null" + s.dialect.forUpdate); err != nil {
+			return err
+		}
+		var before, after int
+		if err := tx.QueryRow("select count(*) from plages").Scan(&before); err != nil {
+			return err
+		}
+		if err := s.derivePlages(tx, time.Time{}); err != nil {
+			return err
+		}
+		if err := tx.QueryRow("select count(*) from plages").Scan(&after); err != nil {
+			return err
+		}
+		return writeAudit(tx, actor, AuditRebuildTimeRanges, 0, map[string]interface{}{"plages": before}, map[string]interface{}{"plages": after})
+	})
+	return unavailable("rebuild time-ranges", err)
+}
+
+// A session as seen by derivePlages : its times, set from its events, and its link if it has one yet.
+type derivedSession struct {
+	id, userID   int
+	start        time.Time
+	stop         sql.NullTime
+	connected    bool         // Its connect event was read
+	cachedStop   sql.NullTime // sessions.stop, set again from stop if they differ
+	linkID       int          // 0 if it has no link yet
+	startPlageID int
+	endPlageID   sql.NullInt32
+	computed     bool // Its energy was computed already
+}
+
+// Whether the session is open at the time t, when a time-range starts. A session that closed as soon as it opened
+// counts in the time-range starting then.
+func (d derivedSession) covers(t time.Time) bool {
+	if d.start.After(t) {
+		return false
+	}
+	return !d.stop.Valid || d.stop.Time.After(t) || (d.stop.Time.Equal(t) && d.start.Equal(t))
+}
+
+// A time-range kept or created by derivePlages.
+type derivedPlage struct {
+	id    int
+	start time.Time
+}
+
+// Derive the time-ranges and the links again from the time from, after an event happened then (inside tx, the open
+// time-range being locked). A time-range starts at each connection, each disconnection and the end of each downtime, with
+// the numbers of users and sessions open then ; the downtimes are covered by none. The time-ranges starting from
+// from are replaced (the ids stay in the order of time) along with the ends of the links and downtimes that
+// referenced them. The energy of the sessions whose time-ranges changed must be computed again.
+// With an event happening now, this only starts a new time-range, like the connections always did.
+func (s *SQLStore) derivePlages(tx *sql.Tx, from time.Time) error {
+	// The last time-range starting before from, which is kept along with the ones before it, compared here
+	// since sqlite stores the times as text. The events after from can't change them.
+	var keep derivedPlage
+	for before := int(^uint32(0) >> 1); keep.id == 0; {
+		rows, err := tx.Query("select id, start from plages where id < $1 order by id desc limit 100", before)
+		if err != nil {
+			return err
+		}
+		n := 0
+		for rows.Next() {
+			var p derivedPlage
+			if err := rows.Scan(&p.id, &p.start); err != nil {
+				rows.Close()
+				return err
+			}
+			n, before = n+1, p.id
+			if keep.id == 0 && p.start.Before(from) {
+				keep = p
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	// The sessions that can be open after it : the ones without link yet (just opened), and the ones whose link
+	// is still open or ended with it or later. Their times are the ones of their events, sessions.stop is only a copy.
+	const derived = `from sessions left join link on link.sessionID = sessions.id
+		where link.id is null or link.endPlageID is null or link.endPlageID >= $1`
+	sessions := []derivedSession{}
+	rows, err := tx.Query(`select sessions.id, sessions.userID, sessions.stop, sessions.energy is not null,
+			coalesce(link.id, 0), coalesce(link.startPlageID, 0), link.endPlageID `+derived+` order by sessions.id`, keep.id)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var d derivedSession
+		if err := rows.Scan(&d.id, &d.userID, &d.cachedStop, &d.computed, &d.linkID, &d.startPlageID, &d.endPlageID); err != nil {
+			rows.Close()
+			return err
+		}
+		sessions = append(sessions, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows, err = tx.Query(`select session_events.sessionID, session_events.kind, session_events.at
+		from session_events join (select sessions.id `+derived+`) derived on derived.id = session_events.sessionID
+		order by session_events.at, session_events.id`, keep.id)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var sessionID int
+		var kind string
+		var at time.Time
+		if err := rows.Scan(&sessionID, &kind, &at); err != nil {
+			rows.Close()
+			return err
+		}
+		i, found := slices.BinarySearchFunc(sessions, sessionID, func(d derivedSession, id int) int { return d.id - id })
+		if !found {
+			continue
+		}
+		switch kind {
+		case EventConnect:
+			sessions[i].start, sessions[i].connected = at, true
+		case EventDisconnect:
+			sessions[i].stop = sql.NullTime{Time: at, Valid: true}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// Without its connection, a session has no time-range
+	sessions = slices.DeleteFunc(sessions, func(d derivedSession) bool { return !d.connected })
+
+	type downtime struct {
+		id          int
+		start, stop time.Time
+	}
+	downtimes := []downtime{}
+	rows, err = tx.Query("select id, start, stop from downtimes order by id")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var d downtime
+		if err := rows.Scan(&d.id, &d.start, &d.stop); err != nil {
+			rows.Close()
+			return err
+		}
+		downtimes = append(downtimes, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// The times a time-range starts or ends at, after the start of the kept one
+	after := func(t time.Time) bool { return keep.id == 0 || t.After(keep.start) }
+	boundaries := []time.Time{}
+	for _, d := range sessions {
+		boundaries = append(boundaries, d.start)
+		if d.stop.Valid {
+			boundaries = append(boundaries, d.stop.Time)
+		}
+	}
+	for _, d := range downtimes {
+		boundaries = append(boundaries, d.start, d.stop)
+	}
+	boundaries = slices.DeleteFunc(boundaries, func(t time.Time) bool { return !after(t) })
+	slices.SortFunc(boundaries, func(a, b time.Time) int { return a.Compare(b) })
+	boundaries = slices.CompactFunc(boundaries, func(a, b time.Time) bool { return a.Equal(b) })
+	down := func(t time.Time) bool {
+		return slices.ContainsFunc(downtimes, func(d downtime) bool { return !t.Before(d.start) && t.Before(d.stop) })
+	}
+
+	// The new time-ranges get greater ids than the old ones, which are deleted once nothing references them
+	var oldMax int
+	if err := tx.QueryRow("select coalesce(max(id), 0) from plages").Scan(&oldMax); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("update plages set stop = start where id > $1 and stop is null", keep.id); err != nil {
+		return err
+	}
+	plages := []derivedPlage{}
+	if keep.id != 0 {
+		plages = append(plages, keep)
+		var stop interface{}
+		if len(boundaries) > 0 {
+			stop = boundaries[0]
+		}
+		if _, err := tx.Exec("update plages set stop = $1 where id = $2", stop, keep.id); err != nil {
+			return err
+		}
+	}
+	for i, b := range boundaries {
+		if down(b) {
+			continue
+		}
+		var stop interface{}
+		if i+1 < len(boundaries) {
+			stop = boundaries[i+1]
+		}
+		users := map[int]bool{}
+		nbrSessions := 0
+		for _, d := range sessions {
+			if d.covers(b) {
+				users[d.userID] = true
+				nbrSessions++
+			}
+		}
+		p := derivedPlage{start: b}
+		if err := tx.QueryRow("insert into plages (start, stop, nbr_users, nbr_sessions) values ($1, $2, $3, $4) returning id",
+			b, stop, len(users), nbrSessions).Scan(&p.id); err != nil {
+			return err
+		}
+		plages = append(plages, p)
+	}
+
+	// The last time-range starting at t or before (strictly before if strict), the first one if there is none
+	plageAt := func(t time.Time, strict bool) (int, bool) {
+		id, found := 0, false
+		for _, p := range plages {
+			if p.start.After(t) || (strict && p.start.Equal(t)) {
+				break
+			}
+			id, found = p.id, true
+		}
+		if !found && len(plages) > 0 {
+			id = plages[0].id
+		}
+		return id, found
+	}
+
+	for _, d := range sessions {
+		startPlageID := d.startPlageID
+		if d.linkID == 0 || after(d.start) {
+			startPlageID, _ = plageAt(d.start, false)
+			// Opened while the server was down : it starts with the first time-range after the downtime
+			if i := slices.IndexFunc(plages, func(p derivedPlage) bool { return p.start.After(d.start) }); down(d.start) && i >= 0 {
+				startPlageID = plages[i].id
+			}
+		}
+		endPlageID := d.endPlageID
+		if d.stop.Valid && (!endPlageID.Valid || after(d.stop.Time)) {
+			id, _ := plageAt(d.stop.Time, true)
+			endPlageID = sql.NullInt32{Int32: int32(max(id, startPlageID)), Valid: true}
+		} else if !d.stop.Valid {
+			endPlageID = sql.NullInt32{}
+		}
+		if d.stop.Valid != d.cachedStop.Valid || !d.stop.Time.Equal(d.cachedStop.Time) {
+			if _, err := tx.Exec("update sessions set stop = $1 where id = $2", d.stop, d.id); err != nil {
+				return err
+			}
+		}
+		if startPlageID == 0 { // No time-range at all : there is no session either
+			continue
+		}
+		if d.linkID == 0 {
+			if _, err := tx.Exec("insert into link (userID, startPlageID, endPlageID, sessionID) values ($1, $2, $3, $4)",
+				d.userID, startPlageID, endPlageID, d.id); err != nil {
+				return err
+			}
+		} else if startPlageID != d.startPlageID || endPlageID != d.endPlageID {
+			if _, err := tx.Exec("update link set startPlageID = $1, endPlageID = $2 where id = $3", startPlageID, endPlageID, d.linkID); err != nil {
+				return err
+			}
+		}
+		// Its share of the time-ranges after from may have changed
+		if d.computed && d.stop.Valid && d.stop.Time.After(from) {
+			if _, err := tx.Exec("update sessions set energy = null, energy_unit = '', computed_at = null where id = $1", d.id); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, d := range downtimes {
+		if !after(d.start) {
+			continue
+		}
+		var lastPlageID interface{}
+		if id, found := plageAt(d.start, true); found {
+			lastPlageID = id
+		}
+		if _, err := tx.Exec("update downtimes set lastPlageID = $1 where id = $2", lastPlageID, d.id); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("delete from plages where id > $1 and id <= $2", keep.id, oldMax)
+	return err
+}
@@ -0,0 +1,205 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The time-ranges and links of a store, with their times as offsets from t0 so that they can be compared
+// whatever their ids : "1h0m0s-2h0m0s 1/1" for a time-range with 1 user and 1 session, "user 2: 1h0m0s-open" for a link
+// (the starts of its first and last time-ranges), in the order of the sessions.
+type derivedState struct {
+	plages []string
+	links  []string
+}
+
+func readDerivedState(t *testing.T, s *SQLStore, t0 time.Time) derivedState {
+	t.Helper()
+	state := derivedState{plages: []string{}, links: []string{}}
+	starts := map[int]time.Duration{}
+	rows, err := s.db.Query("select " + plageColumns + " from plages order by id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		tr, err := scanTimeRange(rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		starts[tr.ID] = tr.Start.Sub(t0)
+		stop := "open"
+		if tr.Stop.Valid {
+			stop = tr.Stop.Time.Sub(t0).String()
+		}
+		state.plages = append(state.plages, fmt.Sprintf("%s-%s %d/%d", tr.Start.Sub(t0), stop, tr.NbrUsers, tr.NbrSessions))
+	}
+	rows.Close()
+
+	rows, err = s.db.Query("select userID, startPlageID, endPlageID from link order by sessionID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID, startPlageID int
+		var endPlageID sql.NullInt32
+		if err := rows.Scan(&userID, &startPlageID, &endPlageID); err != nil {
+			t.Fatal(err)
+		}
+		end := "open"
+		if endPlageID.Valid {
+			end = starts[int(endPlageID.Int32)].String()
+		}
+		state.links = append(state.links, fmt.Sprintf("user %d: %s-%s", userID, starts[startPlageID], end))
+	}
+	return state
+}
+
+// A session opened (close false) or closed (close true) at t0 plus at hours. The sessions are numbered
+// from 0 in the order they were opened.
+type sessionStep struct {
+	close   bool
+	user    int // User of the session opened
+	session int // Session closed
+	at      float64
+}
+
+func TestDerivePlages(t *testing.T) {
+	cases := []struct {
+		name      string
+		downtimes [][2]float64 // Start and stop, in hours after t0
+		steps     []sessionStep
+		want      derivedState
+	}{
+		{
+			name:  "late connection before the existing time-ranges",
+			steps: []sessionStep{{user: 1, at: 2}, {user: 2, at: 3}, {user: 3, at: 1}},
+			want: derivedState{
+				plages: []string{"1h0m0s-2h0m0s 1/1", "2h0m0s-3h0m0s 2/2", "3h0m0s-open 3/3"},
+				links:  []string{"user 1: 2h0m0s-open", "user 2: 3h0m0s-open", "user 3: 1h0m0s-open"},
+			},
+		},
+		{
+			name:  "close sent after a later connection",
+			steps: []sessionStep{{user: 1, at: 1}, {user: 2, at: 2}, {close: true, session: 0, at: 1.5}},
+			want: derivedState{
+				plages: []string{"1h0m0s-1h30m0s 1/1", "1h30m0s-2h0m0s 0/0", "2h0m0s-open 1/1"},
+				links:  []string{"user 1: 1h0m0s-1h0m0s", "user 2: 2h0m0s-open"},
+			},
+		},
+		{
+			// It counts in the time-range starting then, so that it isn't lost
+			name:  "close at the time of the connection",
+			steps: []sessionStep{{user: 1, at: 1}, {close: true, session: 0, at: 1}, {user: 2, at: 2}},
+			want: derivedState{
+				plages: []string{"1h0m0s-2h0m0s 1/1", "2h0m0s-open 1/1"},
+				links:  []string{"user 1: 1h0m0s-1h0m0s", "user 2: 2h0m0s-open"},
+			},
+		},
+		{
+			// No time-range covers the downtime, the session opened during it starts after it
+			name:      "connection inside a downtime",
+			downtimes: [][2]float64{{2, 4}},
+			steps:     []sessionStep{{user: 1, at: 1}, {user: 2, at: 3}, {close: true, session: 0, at: 5}},
+			want: derivedState{
+				plages: []string{"1h0m0s-2h0m0s 1/1", "4h0m0s-5h0m0s 2/2", "5h0m0s-open 1/1"},
+				links:  []string{"user 1: 1h0m0s-4h0m0s", "user 2: 4h0m0s-open"},
+			},
+		},
+		{
+			// The session ends with the last time-range before the downtime
+			name:      "close inside a downtime",
+			downtimes: [][2]float64{{2, 4}},
+			steps:     []sessionStep{{user: 1, at: 1}, {user: 2, at: 1.5}, {close: true, session: 0, at: 3}},
+			want: derivedState{
+				plages: []string{"1h0m0s-1h30m0s 1/1", "1h30m0s-2h0m0s 2/2", "4h0m0s-open 1/1"},
+				links:  []string{"user 1: 1h0m0s-1h30m0s", "user 2: 1h30m0s-open"},
+			},
+		},
+	}
+	forEachDialect(t, func(t *testing.T, s *SQLStore) {
+		migrated(t, s)
+		t0 := time.Now().UTC().Add(-10 * time.Hour).Truncate(time.Second)
+		hours := func(h float64) time.Time { return t0.Add(time.Duration(h * float64(time.Hour))) }
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				if err := s.Reset("test"); err != nil {
+					t.Fatal(err)
+				}
+				migrated(t, s)
+				for _, d := range tc.downtimes {
+					if _, err := s.db.Exec("insert into downtimes (start, stop) values ($1, $2)", hours(d[0]), hours(d[1])); err != nil {
+						t.Fatal(err)
+					}
+				}
+				sessions := []int{}
+				for _, step := range tc.steps {
+					if step.close {
+						if err := s.CloseSessionAt(sessions[step.session], hours(step.at), "test"); err != nil {
+							t.Fatalf("%+v: %v", step, err)
+						}
+						continue
+					}
+					session, err := s.OpenSession(step.user, SessionInfo{Host: "node1"}, hours(step.at), "test", "")
+					if err != nil {
+						t.Fatalf("%+v: %v", step, err)
+					}
+					sessions = append(sessions, session.ID)
+				}
+
+				derived := readDerivedState(t, s, t0)
+				if !reflect.DeepEqual(derived, tc.want) {
+					t.Errorf("derived as the events came\n got %v\nwant %v", derived, tc.want)
+				}
+				// Deriving everything at once from the events gives the same
+				if err := s.RebuildTimeRanges("test"); err != nil {
+					t.Fatal(err)
+				}
+				if rebuilt := readDerivedState(t, s, t0); !reflect.DeepEqual(rebuilt, derived) {
+					t.Errorf("rebuilt\n got %v\nwant %v", rebuilt, derived)
+				}
+			})
+		}
+	})
+}
+
+// A disconnect event recorded by another way than CloseSessionAt (a remote agent sending it late, a backfill) is
+// taken into account by the next derivation, and sessions.stop follows it.
+func TestRebuildTimeRangesLateEvent(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, s *SQLStore) {
+		migrated(t, s)
+		t0 := time.Now().UTC().Add(-10 * time.Hour).Truncate(time.Second)
+		first, err := s.OpenSession(1, SessionInfo{Host: "node1"}, t0.Add(time.Hour), "test", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.OpenSession(2, SessionInfo{Host: "node1"}, t0.Add(2*time.Hour), "test", ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.db.Exec("insert into session_events (sessionID, kind, at, recorded_at, source) values ($1, $2, $3, $4, $5)",
+			first.ID, EventDisconnect, t0.Add(3*time.Hour), time.Now().UTC(), "agent"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RebuildTimeRanges("test"); err != nil {
+			t.Fatal(err)
+		}
+
+		want := derivedState{
+			plages: []string{"1h0m0s-2h0m0s 1/1", "2h0m0s-3h0m0s 2/2", "3h0m0s-open 1/1"},
+			links:  []string{"user 1: 1h0m0s-2h0m0s", "user 2: 2h0m0s-open"},
+		}
+		if got := readDerivedState(t, s, t0); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v\nwant %v", got, want)
+		}
+		var stop sql.NullTime
+		if err := s.db.QueryRow("select stop from sessions where id = $1", first.ID).Scan(&stop); err != nil {
+			t.Fatal(err)
+		}
+		if !stop.Valid || !stop.Time.Equal(t0.Add(3*time.Hour)) {
+			t.Errorf("stop of the session %v, want %v", stop, t0.Add(3*time.Hour))
+		}
+	})
+}
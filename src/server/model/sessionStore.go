@@ -0,0 +1,152 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// SessionStore keeps the users, the time-ranges (plages) and the links between them.
+// The controller only uses this interface, so the sessions can be stored either in postgres (NewPostgresStore)
+// or, for single-server deployments, in a sqlite file (NewSQLiteStore).
+type SessionStore interface {
+	GetUsers() ([]User, error)
+	GetUsersIDs() ([]int, error)
+	GetUserById(id int) (User, error)
+	GetUserTimesById(id int) ([]Link, error)
+	GetUserTimes(id int) ([]TimeRange, error)
+	GetAllUserTimes() (map[int][]TimeRange, error)
+	GetTimeRanges() ([]TimeRange, error)
+	GetEarliestTimeRange(id int) (TimeRange, error)
+	GetTimerangeById(id int) (TimeRange, error)
+	GetUserByExternalID(identity Identity) (User, error)
+	GetGroups(kind string) ([]Group, error)
+	GetGroupById(id int) (Group, error)
+	GetGroupMembers(id int) ([]int, error)
+	GetGroupTimes(id int) ([]TimeRange, error)
+	GetAllGroupTimes(kind string) (map[int][]TimeRange, error)
+	GetUserSessions(id int) ([]Session, error)
+	GetSessionById(id int) (Session, error)
+	GetSessionsToCompute(limit int) ([]Session, error)
+	GetSessionTimes(id int) ([]TimeRange, error)
+	GetAuditLog(userID int, from, to time.Time, limit int) ([]AuditEntry, error)
+	GetDowntimes() ([]Downtime, error)
+	GetSessionEvents(after, limit int) ([]SessionEvent, error)
+
+	Reset(actor string) error
+	DemarrageServeur() error
+	Heartbeat() error
+	EraseUser(id int, mode, actor, reason string) (ErasureReport, error)
+	NewUserConnection(info SessionInfo, actor string) (int, error)
+	UserConnection(id int, info SessionInfo, actor string) error
+	UserDeconnection(id int, actor string) error
+	CloseSession(sessionID int, actor string) error
+	CloseSessionAt(sessionID int, at time.Time, actor string) error
+	RebuildTimeRanges(actor string) error
+	UserHeartbeat(id int) error
+	SessionHeartbeat(sessionID int) error
+	DisconnectIdleSessions(timeout time.Duration, actor string) ([]int, error)
+	AddIdentity(id int, identity Identity) error
+	UpdateUserProfile(id int, displayName, team string, labels map[string]string) error
+	SetUserTimezone(id int, timezone string) error
+	ExternalUserConnection(identity Identity, info SessionInfo, actor string) (int, error)
+	OpenExternalSession(identity Identity, info SessionInfo, at time.Time, actor, requestKey string) (Session, error)
+	OpenSession(id int, info SessionInfo, at time.Time, actor, requestKey string) (Session, error)
+	CreateUser(displayName, team string, labels map[string]string, identities []Identity, actor, requestKey string) (User, error)
+	ExternalUserDeconnection(identity Identity, actor string) error
+	CreateGroup(name, kind string, parentID int) (int, error)
+	AddGroupMember(groupID, userID int) error
+	RemoveGroupMember(groupID, userID int) error
+	SetSessionEnergy(id int, energy float64, unit string) error
+
+	Migrate() (int, error)
+	Rollback(steps int) (int, error)
+	MigrationStatus() ([]MigrationState, error)
+	Close() error
+}
+
+// What differs between the sql databases. Everything else is written once, in standard sql
+// with $1 placeholders which both drivers understand.
+type dialect struct {
+	name      string // Name of the folder of its migrations
+	isolation sql.IsolationLevel
+	forUpdate string // Suffix locking the rows read by a select, empty if the database locks the whole file
+	retryable func(err error) bool
+	// Statement making the ids of the users allocated by the database larger than $1, an id chosen by the caller.
+	// Empty if the database already does it (sqlite AUTOINCREMENT)
+	advanceUserIDs string
+	// Format of the expression of a time (column or parameter) that compares in the order of time, for fmt.Sprintf
+	orderedTime string
+}
+
+var postgresDialect = dialect{
+	name:      "postgres",
+	isolation: sql.LevelSerializable,
+	forUpdate: " for update",
+	retryable: func(err error) bool {
+		// Serialization failure or deadlock caused by a concurrent transaction
+		var pqErr *pq.Error
+		return errors.As(err, &pqErr) && (pqErr.Code == "40001" || pqErr.Code == "40P01")
+	},
+	// Only moved forward, so that the ids of the users deleted are never given again
+	advanceUserIDs: `select setval(pg_get_serial_sequence('users', 'id'), $1::bigint)
+		where $1::bigint > coalesce(pg_sequence_last_value(pg_get_serial_sequence('users', 'id')::regclass), 0)`,
+	orderedTime: "%s",
+}
+
+// The sqlite transactions take the write lock as soon as they begin (_txlock=immediate),
+// so they never conflict and don't need row locks.
+var sqliteDialect = dialect{
+	name:      "sqlite",
+	isolation: sql.LevelDefault,
+	retryable: func(err error) bool { return false },
+	// The times are stored as the text of time.Time.String, in UTC, whose fractions of seconds have no fixed length :
+	// they are compared to the millisecond, once their time zone is removed for strftime
+	orderedTime: "strftime('%%Y-%%m-%%d %%H:%%M:%%f', replace(%s, ' +0000 UTC', ''))",
+}
+
+// SQLStore is the SessionStore backed by a sql database, postgres or sqlite.
+type SQLStore struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+var _ SessionStore = (*SQLStore)(nil)
+
+// Connects to the postgres db.
+func NewPostgresStore(username, password, host, port, dbname string) (*SQLStore, error) {
+	connString := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		host, port, username, password, dbname)
+	db, err := sql.Open("postgres", connString)
+	if err != nil {
+		return nil, invalidInput("bad postgres connection string: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, unavailable("couldn't achieve connection with database", err)
+	}
+
+	return &SQLStore{db: db, dialect: postgresDialect}, nil
+}
+
+// Open (or create) the sqlite database stored in the file at path.
+func NewSQLiteStore(path string) (*SQLStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(10000)&_txlock=immediate")
+	if err != nil {
+		return nil, invalidInput("bad sqlite path: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, unavailable("couldn't open the sqlite database", err)
+	}
+
+	return &SQLStore{db: db, dialect: sqliteDialect}, nil
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
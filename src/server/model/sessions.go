@@ -0,0 +1,184 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Where a connection comes from. Everything is optional.
+type SessionInfo struct {
+	Host       string `json:"host"`       // Server the user connected to
+	SourceIP   string `json:"sourceIP"`   // Address the user connected from
+	ClientType string `json:"clientType"` // ssh, jupyter, web...
+}
+
+// A Session is one connection of a user, from UserConnection to UserDeconnection.
+// Its energy is the share of the consumption of its host attributed to the user during the session,
+// computed once the session is closed (see SetSessionEnergy), in the unit of the energy points.
+type Session struct {
+	ID     int          `json:"id"`
+	UserID int          `json:"userID"`
+	Start  time.Time    `json:"start"`
+	Stop   sql.NullTime `json:"stop"`
+	SessionInfo
+	LastSeen     sql.NullTime    `json:"lastSeen"` // Last heartbeat of the client, see UserHeartbeat
+	Energy       sql.NullFloat64 `json:"energy"`
+	Unit         string          `json:"unit"`
+	Duration     float64         `json:"duration"`     // In seconds, until now if the session is still open
+	AveragePower sql.NullFloat64 `json:"averagePower"` // In W, when the energy is known in J or mWh
+}
+
+const sessionColumns = "id, userID, start, stop, host, source_ip, client_type, last_seen, energy, energy_unit"
+
+// Return how many joules a value of energy in unit is, or false if the unit is unknown.
+func ToJoules(value float64, unit string) (float64, bool) {
+	switch unit {
+	case "J":
+		return value, true
+	case "mWh":
+		return value * 3.6, true
+	}
+	return 0, false
+}
+
+func scanSession(row rowScanner) (Session, error) {
+	var s Session
+	if err := row.Scan(&s.ID, &s.UserID, &s.Start, &s.Stop, &s.Host, &s.SourceIP, &s.ClientType, &s.LastSeen, &s.Energy, &s.Unit); err != nil {
+		return s, err
+	}
+	stop := time.Now()
+	if s.Stop.Valid {
+		stop = s.Stop.Time
+	}
+	s.Duration = stop.Sub(s.Start).Seconds()
+	if joules, ok := ToJoules(s.Energy.Float64, s.Unit); ok && s.Energy.Valid && s.Duration > 0 {
+		s.AveragePower = sql.NullFloat64{Float64: joules / s.Duration, Valid: true}
+	}
+	return s, nil
+}
+
+func (s *SQLStore) querySessions(what, query string, args ...interface{}) ([]Session, error) {
+	sessions := []Session{}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, unavailable(what, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, unavailable(what, err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, unavailable(what, rows.Err())
+}
+
+// Return the session with this id, or ErrNotFound.
+func (s *SQLStore) GetSessionById(id int) (Session, error) {
+	session, err := scanSession(s.db.QueryRow("select "+sessionColumns+" from sessions where id = $1", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return session, notFound("no session with id %d", id)
+	}
+	return session, unavailable("get session", err)
+}
+
+// Same as UserConnection, but return the session opened, so that it can be closed alone with CloseSession.
+// at is when the session opened, now if it is the zero time : a session opened earlier (sent late by a remote agent,
+// or backfilled) is counted in the time-ranges from then on.
+// If requestKey is not empty and a session was already opened with it, nothing is done and that session is returned.
+func (s *SQLStore) OpenSession(id int, info SessionInfo, at time.Time, actor, requestKey string) (Session, error) {
+	if id < 0 {
+		return Session{}, invalidInput("negative user id %d", id)
+	}
+	at, err := eventTime(at)
+	if err != nil {
+		return Session{}, err
+	}
+	sessionID, err := s.withRequestKey(requestKey, "open_session", func(tx *sql.Tx) (int, error) {
+		return s.userConnection(tx, id, info, at, actor)
+	})
+	if err != nil {
+		return Session{}, unavailable("connection of the user", err)
+	}
+	return s.GetSessionById(sessionID)
+}
+
+// Return all the sessions of the user, the most recent first.
+func (s *SQLStore) GetUserSessions(id int) ([]Session, error) {
+	return s.querySessions("get user sessions", "select "+sessionColumns+" from sessions where userID = $1 order by id desc", id)
+}
+
+// Return at most limit closed sessions whose energy hasn't been computed yet, the oldest first.
+func (s *SQLStore) GetSessionsToCompute(limit int) ([]Session, error) {
+	return s.querySessions("get sessions to compute",
+		"select "+sessionColumns+" from sessions where energy is null and stop is not null order by id limit $1", limit)
+}
+
+// Return the time-ranges the session went through, from its first one to its last one,
+// with the number of sessions its user had open during each of them.
+func (s *SQLStore) GetSessionTimes(id int) ([]TimeRange, error) {
+	timeRanges := []TimeRange{}
+	rows, err := s.db.Query(`select plages.id, plages.start, plages.stop, plages.nbr_users, plages.nbr_sessions,
+			(select count(*) from link other where other.userID = link.userID and other.startPlageID <= plages.id
+				and (other.endPlageID is null or other.endPlageID >= plages.id))
+		from link join plages on plages.id >= link.startPlageID and plages.id <= coalesce(link.endPlageID,
+			(select id from plages where stop is null order by id desc limit 1))
+		where link.sessionID = $1 order by plages.id`, id)
+	if err != nil {
+		return nil, unavailable("get session time-ranges", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t := TimeRange{Sessions: 1}
+		if err := rows.Scan(&t.ID, &t.Start, &t.Stop, &t.NbrUsers, &t.NbrSessions, &t.UserSessions); err != nil {
+			return nil, unavailable("get session time-ranges", err)
+		}
+		timeRanges = append(timeRanges, t)
+	}
+	return timeRanges, unavailable("get session time-ranges", rows.Err())
+}
+
+// Store the energy attributed to the session, in unit.
+func (s *SQLStore) SetSessionEnergy(id int, energy float64, unit string) error {
+	res, err := s.db.Exec("update sessions set energy = $1, energy_unit = $2, computed_at = $3 where id = $4",
+		energy, unit, time.Now().UTC(), id)
+	if err != nil {
+		return unavailable("set session energy", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return notFound("no session with id %d", id)
+	}
+	return nil
+}
+
+// Open a session for the user at the time at inside tx, and derive the time-ranges again from then.
+// source is who sent the connection. Return the id of the session and of the time-range it starts with.
+func (s *SQLStore) openSession(tx *sql.Tx, id int, info SessionInfo, at time.Time, source string) (sessionID, plageID int, err error) {
+	if err := tx.QueryRow(`insert into sessions (userID, start, host, source_ip, client_type)
+		values ($1, $2, $3, $4, $5) returning id`, id, at, info.Host, info.SourceIP, info.ClientType).Scan(&sessionID); err != nil {
+		return 0, 0, err
+	}
+	if err := appendEvent(tx, sessionID, EventConnect, at, source); err != nil {
+		return 0, 0, err
+	}
+	if err := s.derivePlages(tx, at); err != nil {
+		return 0, 0, err
+	}
+	err = tx.QueryRow("select startPlageID from link where sessionID = $1", sessionID).Scan(&plageID)
+	return sessionID, plageID, err
+}
+
+// Close the session at the time stop inside tx, if it is still open. source is who sent the disconnection.
+// The time-ranges must be derived again from stop afterwards.
+func closeSession(tx *sql.Tx, sessionID int, stop time.Time, source string) error {
+	res, err := tx.Exec("update sessions set stop = $1 where id = $2 and stop is null", stop, sessionID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	return appendEvent(tx, sessionID, EventDisconnect, stop, source)
+}
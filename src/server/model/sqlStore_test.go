@@ -0,0 +1,293 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Environment variable giving the connection string of a postgres database the tests can wipe,
+// like "host=localhost user=test password=test dbname=test sslmode=disable". Without it, only sqlite is tested.
+const testPostgresEnv = "TEST_POSTGRES_DSN"
+
+// Run test on an empty store of each dialect : a new sqlite file, and the postgres database of TEST_POSTGRES_DSN
+// (skipped if it is not set) with every migration reverted first. The migrations are not applied.
+func forEachDialect(t *testing.T, test func(t *testing.T, s *SQLStore)) {
+	t.Run("sqlite", func(t *testing.T) {
+		s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "sessions.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		test(t, s)
+	})
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv(testPostgresEnv)
+		if dsn == "" {
+			t.Skip(testPostgresEnv + " is not set")
+		}
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &SQLStore{db: db, dialect: postgresDialect}
+		defer s.Close()
+		migrations, err := Migrations(postgresDialect.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Rollback(len(migrations)); err != nil {
+			t.Fatal(err)
+		}
+		test(t, s)
+	})
+}
+
+// Return a store of the dialect with every migration applied, see forEachDialect.
+func migrated(t *testing.T, s *SQLStore) *SQLStore {
+	t.Helper()
+	if _, err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, s *SQLStore) {
+		migrations, err := Migrations(s.dialect.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		steps := []struct {
+			name    string
+			run     func() (int, error)
+			count   int
+			applied int
+		}{
+			{"up", s.Migrate, len(migrations), len(migrations)},
+			{"up again", s.Migrate, 0, len(migrations)},
+			{"down one", func() (int, error) { return s.Rollback(1) }, 1, len(migrations) - 1},
+			{"up the last one", s.Migrate, 1, len(migrations)},
+			{"down all", func() (int, error) { return s.Rollback(len(migrations) + 1) }, len(migrations), 0},
+			{"up from scratch", s.Migrate, len(migrations), len(migrations)},
+		}
+		for _, step := range steps {
+			count, err := step.run()
+			if err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+			if count != step.count {
+				t.Errorf("%s: %d migrations run, want %d", step.name, count, step.count)
+			}
+			states, err := s.MigrationStatus()
+			if err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+			applied := 0
+			for _, state := range states {
+				if state.AppliedAt.Valid {
+					applied++
+				}
+			}
+			if applied != step.applied {
+				t.Errorf("%s: %d migrations applied, want %d", step.name, applied, step.applied)
+			}
+		}
+	})
+}
+
+// A connection (connect true) or a disconnection of a user.
+type connectionEvent struct {
+	userID  int
+	connect bool
+}
+
+// What GetUserTimes returns for a user : how many time-ranges, whether the last one is still open,
+// and the number of users and sessions of each of them.
+type wantTimes struct {
+	count    int
+	lastOpen bool
+	users    []int
+	sessions []int
+}
+
+func TestConnections(t *testing.T) {
+	cases := []struct {
+		name   string
+		events []connectionEvent
+		want   map[int]wantTimes
+	}{
+		{
+			name:   "one user connected",
+			events: []connectionEvent{{1, true}},
+			want:   map[int]wantTimes{1: {1, true, []int{1}, []int{1}}},
+		},
+		{
+			name:   "one user connected and disconnected",
+			events: []connectionEvent{{1, true}, {1, false}},
+			want:   map[int]wantTimes{1: {1, false, []int{1}, []int{1}}},
+		},
+		{
+			name:   "two users overlapping",
+			events: []connectionEvent{{1, true}, {2, true}, {1, false}},
+			want: map[int]wantTimes{
+				1: {2, false, []int{1, 2}, []int{1, 2}},
+				2: {2, true, []int{2, 1}, []int{2, 1}},
+			},
+		},
+		{
+			name:   "two sessions of the same user",
+			events: []connectionEvent{{1, true}, {1, true}, {1, false}},
+			want:   map[int]wantTimes{1: {2, false, []int{1, 1}, []int{1, 2}}},
+		},
+		{
+			name:   "disconnection of a user not connected",
+			events: []connectionEvent{{1, true}, {2, false}},
+			want:   map[int]wantTimes{1: {1, true, []int{1}, []int{1}}, 2: {0, false, nil, nil}},
+		},
+	}
+	forEachDialect(t, func(t *testing.T, s *SQLStore) {
+		migrated(t, s)
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				if err := s.Reset("test"); err != nil {
+					t.Fatal(err)
+				}
+				migrated(t, s)
+				for _, e := range tc.events {
+					var err error
+					if e.connect {
+						err = s.UserConnection(e.userID, SessionInfo{Host: "node1", ClientType: "ssh"}, "test")
+					} else {
+						err = s.UserDeconnection(e.userID, "test")
+					}
+					if err != nil {
+						t.Fatalf("%+v: %v", e, err)
+					}
+				}
+				for userID, want := range tc.want {
+					times, err := s.GetUserTimes(userID)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(times) != want.count {
+						t.Fatalf("user %d: %d time-ranges, want %d", userID, len(times), want.count)
+					}
+					if want.count == 0 {
+						continue
+					}
+					if open := !times[len(times)-1].Stop.Valid; open != want.lastOpen {
+						t.Errorf("user %d: last time-range open %t, want %t", userID, open, want.lastOpen)
+					}
+					for i, tr := range times {
+						if tr.NbrUsers != want.users[i] || tr.NbrSessions != want.sessions[i] {
+							t.Errorf("user %d, time-range %d: %d users and %d sessions, want %d and %d",
+								userID, i, tr.NbrUsers, tr.NbrSessions, want.users[i], want.sessions[i])
+						}
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestReset(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, s *SQLStore) {
+		migrated(t, s)
+		for _, id := range []int{1, 2} {
+			if err := s.UserConnection(id, SessionInfo{Host: "node1"}, "test"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Reset("test"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the audit log is left, along with its migrations
+		states, err := s.MigrationStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, state := range states {
+			kept := false
+			for _, v := range auditMigrations {
+				kept = kept || v == state.Version
+			}
+			if state.AppliedAt.Valid != kept {
+				t.Errorf("migration %d applied %t after the reset, want %t", state.Version, state.AppliedAt.Valid, kept)
+			}
+		}
+		migrated(t, s)
+		users, err := s.GetUsers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 0 {
+			t.Errorf("%d users after the reset, want none", len(users))
+		}
+		times, err := s.GetTimeRanges()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(times) != 0 {
+			t.Errorf("%d time-ranges after the reset, want none", len(times))
+		}
+
+		entries, err := s.GetAuditLog(0, time.Time{}, time.Time{}, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 3 || entries[0].Action != AuditReset {
+			t.Fatalf("audit log %+v, want the 2 connections and the reset", entries)
+		}
+		var previous map[string]int
+		if err := json.Unmarshal(entries[0].Previous, &previous); err != nil {
+			t.Fatal(err)
+		}
+		if previous["users"] != 2 || previous["sessions"] != 2 {
+			t.Errorf("reset recorded %v, want 2 users and 2 sessions", previous)
+		}
+	})
+}
+
+// The ids chosen by the callers of UserConnection and the ones allocated by the database never collide.
+func TestUserIDs(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, s *SQLStore) {
+		migrated(t, s)
+		if err := s.UserConnection(5, SessionInfo{Host: "node1"}, "test"); err != nil {
+			t.Fatal(err)
+		}
+		steps := []struct {
+			name   string
+			create func() (int, error)
+			want   int
+		}{
+			{"new user connection", func() (int, error) { return s.NewUserConnection(SessionInfo{Host: "node1"}, "test") }, 6},
+			{"create user", func() (int, error) {
+				u, err := s.CreateUser("Alice", "", nil, []Identity{{Kind: IdentityUsername, Value: "alice"}}, "test", "")
+				return u.ID, err
+			}, 7},
+			{"new identity", func() (int, error) {
+				session, err := s.OpenExternalSession(Identity{Kind: IdentityUsername, Value: "bob"}, SessionInfo{Host: "node1"}, time.Time{}, "test", "")
+				return session.UserID, err
+			}, 8},
+			{"pseudonym", func() (int, error) {
+				report, err := s.EraseUser(8, ErasePseudonymise, "test", "")
+				return report.PseudonymID, err
+			}, 9},
+			{"after an erased user", func() (int, error) { return s.NewUserConnection(SessionInfo{Host: "node1"}, "test") }, 10},
+		}
+		for _, step := range steps {
+			id, err := step.create()
+			if err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+			if id != step.want {
+				t.Errorf("%s: id %d, want %d", step.name, id, step.want)
+			}
+		}
+	})
+}
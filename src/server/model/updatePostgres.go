@@ -1,239 +1,365 @@
 package model
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
 	"math/rand"
+	"strconv"
+	"strings"
 	"time"
 )
 
-func Reset(db *sql.DB) {
-	if _, err := db.Exec("DROP TABLE IF EXISTS users CASCADE"); err != nil {
-		log.Fatal(err)
-	}
-	if _, err := db.Exec("DROP TABLE IF EXISTS plages CASCADE"); err != nil {
-		log.Fatal(err)
-	}
-	if _, err := db.Exec("DROP TABLE IF EXISTS link CASCADE"); err != nil {
-		log.Fatal(err)
+// Drop every table except the audit log, which keeps a record of the reset with the number of rows of each table.
+// DemarrageServeur creates them again.
+func (s *SQLStore) Reset(actor string) error {
+	// The audit log must exist to record the reset
+	if _, err := s.Migrate(); err != nil {
+		return unavailable("migrate", err)
 	}
+	// The tables are dropped before the ones they reference (sqlite has no CASCADE)
+	tables := []string{"request_keys", "downtimes", "heartbeat", "link", "session_events", "sessions", "identities", "group_members", "user_groups", "users", "plages"}
+	err := s.withTx(func(tx *sql.Tx) error {
+		previous := map[string]int{}
+		for _, table := range tables {
+			var n int
+			if err := tx.QueryRow("select count(*) from " + table).Scan(&n); err != nil {
+				return err
+			}
+			previous[table] = n
+		}
+		if err := writeAudit(tx, actor, AuditReset, 0, previous, map[string]interface{}{"tables": tables}); err != nil {
+			return err
+		}
+		for _, table := range tables {
+			if _, err := tx.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+				return err
+			}
+		}
+		// The migrations of the audit log stay applied, the others run again on the next start
+		versions := make([]string, len(auditMigrations))
+		for i, v := range auditMigrations {
+			versions[i] = strconv.Itoa(v)
+		}
+		_, err := tx.Exec("delete from schema_migrations where version not in (" + strings.Join(versions, ", ") + ")")
+		return err
+	})
+	return unavailable("reset", err)
 }
 
-func DemarrageServeur(db *sql.DB) {
+// Close the sessions left open by the previous run at the last time it was known to be running (its last heartbeat),
+// record the time the server was down as a downtime, and derive the time-ranges again from then :
+// the downtime is covered by none, a new one with 0 users starts now.
+func (s *SQLStore) DemarrageServeur() error {
 
 	fmt.Println("-------------- Restarting server... ------------------")
 
-	// Creating the tables if it is the first time the server starts
-	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS users (
-		id SERIAL PRIMARY KEY,
-		start_session TIMESTAMP NOT NULL,
-		end_session TIMESTAMP)
-						`); err != nil {
-		log.Fatal(err)
-	}
-
-	if _, err := db.Exec(`
-	CREATE TABLE IF NOT EXISTS plages (
-		id serial PRIMARY KEY,
-		start TIMESTAMP,
-		stop TIMESTAMP,
-		nbr_users integer)
-`); err != nil {
-		log.Fatal(err)
-	}
-
-	if _, err := db.Exec(`
-	CREATE TABLE IF NOT EXISTS link (
-		id serial PRIMARY KEY,
-		userID integer NOT NULL references users (id),
-		startPlageID integer NOT NULL references plages (id),
-		endPlageID integer references plages (id)) 
-		`); err != nil {
-		log.Fatal(err)
+	// Creating the tables if it is the first time the server starts, or bringing the schema up to date
+	if _, err := s.Migrate(); err != nil {
+		return unavailable("migrate", err)
 	}
 
-	var lastPlageID int
-
-	if err := db.QueryRow("select id from plages where stop is null").Scan(&lastPlageID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return
-		} else {
-			log.Fatal("Database error:", err)
+	err := s.withTx(func(tx *sql.Tx) error {
+		now := time.Now().UTC()
+		var lastPlageID int
+		var lastPlageStart time.Time
+		if err := tx.QueryRow("select id, start from plages where stop is null"+s.dialect.forUpdate).Scan(&lastPlageID, &lastPlageStart); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return heartbeat(tx, now)
+			}
+			return err
 		}
-	}
 
-	if _, err := db.Exec("update link set endPlageID = $1 where endPlageID is null", lastPlageID); err != nil {
-		fmt.Print(err)
-	}
-	var t time.Time
-	if err := db.QueryRow("update plages set stop = $1 where id = $2 returning stop", time.Now().UTC(), lastPlageID).Scan(&t); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			fmt.Println("This shouldn't happen")
-		} else {
-			log.Fatal("Database error:", err)
+		// The sessions still open when the previous run stopped, and their users kept in the audit log
+		sessionIDs, connected := []int{}, []int{}
+		rows, err := tx.Query("select id, userID from sessions where stop is null order by userID, id")
+		if err != nil {
+			return err
 		}
-	}
+		for rows.Next() {
+			var sessionID, userID int
+			if err := rows.Scan(&sessionID, &userID); err != nil {
+				rows.Close()
+				return err
+			}
+			sessionIDs = append(sessionIDs, sessionID)
+			if len(connected) == 0 || connected[len(connected)-1] != userID {
+				connected = append(connected, userID)
+			}
+		}
+		rows.Close()
 
-	if _, err := db.Exec("insert into plages (start, stop, nbr_users) values ($1, null, 0)", t); err != nil {
-		fmt.Print(err)
-	}
+		// Without heartbeat (first start of this version), the sessions end now like before
+		stop, ok, err := lastAlive(tx, lastPlageStart)
+		if err != nil {
+			return err
+		}
+		if !ok || stop.After(now) {
+			stop = now
+		}
 
-}
+		for _, sessionID := range sessionIDs {
+			if err := closeSession(tx, sessionID, stop, "server"); err != nil {
+				return err
+			}
+		}
+		if stop.Before(now) {
+			if _, err := tx.Exec("insert into downtimes (start, stop, lastPlageID) values ($1, $2, $3)", stop, now, lastPlageID); err != nil {
+				return err
+			}
+		}
+		if err := s.derivePlages(tx, stop); err != nil {
+			return err
+		}
+		if err := heartbeat(tx, now); err != nil {
+			return err
+		}
+		return writeAudit(tx, "server", AuditServerRestart, 0,
+			map[string]interface{}{"openPlageID": lastPlageID, "connectedUsers": connected},
+			map[string]interface{}{"lastAlive": stop, "restart": now})
+	})
+	return unavailable("close the previous sessions", err)
 
-// Doesn't delete the user, but forgets to which links he was associated. Some links are now tied to a null user.
-// However if done more than once, the null-user links cannot be differentiated.
-func DissociateUser(db *sql.DB, id int) {
-	if _, err := db.Exec("update link set userID = null where userID = $1", id); err != nil {
-		fmt.Printf("Problem when updating links in dissociateUser: %s", err)
-	}
 }
 
-// Delete the user, but keep its ID on the links associated.
-// The id doesn't refer to anyone, but it allows to make more precise statistics.
-func ForgetUser(db *sql.DB, id int) {
-	if _, err := db.Exec("delete from users where id = $1", id); err != nil {
-		fmt.Printf("Problem when deleting user in forgetUser: %s", err)
+// Run fn inside a serializable transaction, committed if fn returns nil and rolled back otherwise.
+// If the database aborts the transaction because of a concurrent one (serialization failure or deadlock), it is retried.
+func (s *SQLStore) withTx(fn func(tx *sql.Tx) error) error {
+	for attempt := 0; ; attempt++ {
+		err := s.runTx(fn)
+		if attempt < 5 && err != nil && s.dialect.retryable(err) {
+			continue
+		}
+		return err
 	}
 }
 
-func DeleteUser(db *sql.DB, id int) {
-	if _, err := db.Exec("delete from users where id = $1 ", id); err != nil {
-		fmt.Println("Problem with deletion of the user ! " + err.Error())
+func (s *SQLStore) runTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: s.dialect.isolation})
+	if err != nil {
+		return err
 	}
-	if _, err := db.Exec("delete from link where userID = $1", id); err != nil {
-		fmt.Printf("Problem with deletion of the links ! %s", err)
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
 	}
-
+	return tx.Commit()
 }
 
-func NewUserConnection(db *sql.DB) int {
+// Create a new user and connect it, return its id. actor is who asked for it, kept in the audit log.
+func (s *SQLStore) NewUserConnection(info SessionInfo, actor string) (int, error) {
 
 	var id int
-	if err := db.QueryRow(`insert into users (start_session, end_session) values ($1, NULL) returning id`, time.Now()).Scan(&id); err != nil {
-		log.Fatal(err)
-	}
-	var nbrUsers int
-
-	//In every case, we add a new time range
-	if err := db.QueryRow("SELECT COUNT(*) FROM link WHERE link.endPlageID is null").Scan(&nbrUsers); err != nil {
-		log.Fatal(err)
-	}
-	nbrUsers++
-	var plageID int
-	var t time.Time
-	err := db.QueryRow("INSERT INTO plages (start, stop, nbr_users) VALUES ($1, null, $2) RETURNING id, start",
-		time.Now().UTC(), nbrUsers).Scan(&plageID, &t)
+	err := s.withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("select id from plages where stop is null" + s.dialect.forUpdate); err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		if err := tx.QueryRow(`insert into users (start_session, end_session) values ($1, NULL) returning id`, now).Scan(&id); err != nil {
+			return err
+		}
+		//We also add the session, which starts a new time range
+		sessionID, plageID, err := s.openSession(tx, id, info, now, actor)
+		if err != nil {
+			return err
+		}
+		return writeAudit(tx, actor, AuditNewUser, id, nil, map[string]interface{}{"plageID": plageID, "sessionID": sessionID})
+	})
 	if err != nil {
-		log.Fatal(err)
+		return 0, unavailable("new user connection", err)
 	}
 
-	//We end the previous time range
-	if _, err := db.Exec("UPDATE plages SET stop = $1 WHERE id = $2 - 1", t, plageID); err != nil {
-		log.Fatal(err)
-	}
-
-	//We also add a new link
-	if _, err := db.Exec("INSERT INTO link (userID, startPlageID, endPlageID) VALUES ($1, $2, null)", id, plageID); err != nil {
-		log.Fatal(err)
-	}
-
-	return id
+	return id, nil
 
 }
 
 // Add a new connection from the user with ID id. If this user doesn't exists in the database, it is created.
 // It takes care of updating the tables to ensure the database is coherent.
-// If the user exists but is already logged into the server, this function does not do anything.
-func UserConnection(db *sql.DB, id int) {
+// A session is opened with info, even if the user already has some (two ssh connections, two notebooks...) :
+// each session has its own link, see TimeRange.Share for the consumption attributed to each.
+// Everything is done in a single transaction, along with an entry of the audit log recording actor (who asked for the connection).
+func (s *SQLStore) UserConnection(id int, info SessionInfo, actor string) error {
+	if id < 0 {
+		return invalidInput("negative user id %d", id)
+	}
 
-	var temp int
-	var sessionOpen bool
-	if err := db.QueryRow("SELECT count(*) from link where userID = $1 and endPlageID is null", id).Scan(&temp); err != nil {
-		log.Fatal(err)
+	err := s.withTx(func(tx *sql.Tx) error {
+		_, err := s.userConnection(tx, id, info, time.Now().UTC(), actor)
+		return err
+	})
+	return unavailable("connection of the user", err)
+
+}
+
+// Connect the user at the time at inside tx, see UserConnection. Return the id of the session opened.
+func (s *SQLStore) userConnection(tx *sql.Tx, id int, info SessionInfo, at time.Time, actor string) (int, error) {
+	//Lock the open time range before counting the sessions, so that two connections of the same user both see the other one
+	if _, err := tx.Exec("select id from plages where stop is null" + s.dialect.forUpdate); err != nil {
+		return 0, err
 	}
-	sessionOpen = temp > 0
-	if sessionOpen {
-		return
+	var open int
+	if err := tx.QueryRow("SELECT count(*) from sessions where userID = $1 and stop is null", id).Scan(&open); err != nil {
+		return 0, err
+	}
+	//The end of the previous session of the user (if it exists), changed by the disconnection
+	var previous interface{}
+	var endSession sql.NullTime
+	err := tx.QueryRow("select end_session from users where id = $1", id).Scan(&endSession)
+	if err == nil {
+		previous = map[string]interface{}{"end_session": endSession, "openSessions": open}
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
 	}
 	//fmt.Printf("User %d connected at %s", id, time.Now().UTC().String())
-	if _, err := db.Exec(`insert into users (id, start_session, end_session) values ($1, $2, NULL) ON CONFLICT (id) DO NOTHING`,
-		id, time.Now().UTC()); err != nil {
-		log.Fatal(err)
+	if _, err := tx.Exec(`insert into users (id, start_session, end_session) values ($1, $2, NULL) ON CONFLICT (id) DO NOTHING`,
+		id, at); err != nil {
+		return 0, err
 	}
-	var nbrUsers int
-
-	//In every case we add a new time range
-	if err := db.QueryRow("SELECT COUNT(*) FROM link WHERE link.endPlageID is null").Scan(&nbrUsers); err != nil {
-		log.Fatal(err)
+	if s.dialect.advanceUserIDs != "" {
+		if _, err := tx.Exec(s.dialect.advanceUserIDs, id); err != nil {
+			return 0, err
+		}
 	}
-	nbrUsers++
-	var plageID int
-	var t time.Time
-	err := db.QueryRow("INSERT INTO plages (start, stop, nbr_users) VALUES ($1, null, $2) RETURNING id, start",
-		time.Now().UTC(), nbrUsers).Scan(&plageID, &t)
+
+	//We add the session, which starts a new time range with one more session (and one more user if they had none open)
+	sessionID, plageID, err := s.openSession(tx, id, info, at, actor)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
+	return sessionID, writeAudit(tx, actor, AuditConnection, id, previous,
+		map[string]interface{}{"plageID": plageID, "sessionID": sessionID, "at": at})
+}
 
-	//We end the previous time range
-	if _, err := db.Exec("UPDATE plages SET stop = $1 WHERE id = $2 - 1", t, plageID); err != nil {
-		log.Fatal(err)
-	}
+// Disconnect a user specified by id : all their open sessions are closed. If the user wasn't connected in the first place,
+// it does not do anything. It also update the database accordingly, in a single transaction
+// along with an entry of the audit log recording actor (who asked for the disconnection).
+func (s *SQLStore) UserDeconnection(id int, actor string) error {
 
-	//We also add a new link
-	if _, err := db.Exec("INSERT INTO link (userID, startPlageID, endPlageID) VALUES ($1, $2, null)", id, plageID); err != nil {
-		log.Fatal(err)
-	}
+	err := s.withTx(func(tx *sql.Tx) error {
+		return s.userDeconnection(tx, id, actor)
+	})
+	return unavailable("disconnection of the user", err)
+}
 
+// Close only the session with this id, the other sessions of its user stay open. If it is already closed,
+// it does not do anything, if it doesn't exist the error wraps ErrNotFound.
+func (s *SQLStore) CloseSession(sessionID int, actor string) error {
+	return s.CloseSessionAt(sessionID, time.Time{}, actor)
 }
 
-// Disconnect a user specified by id. If the user wasn't connected in the first place, it does not do anything.
-// It also update the database accordingly.
-func UserDeconnection(db *sql.DB, id int) {
+// Same as CloseSession, with the session closed at the time at (now if it is the zero time) : a disconnection sent
+// late by a remote agent, or backfilled, takes effect in the time-ranges from then on. at must not be before
+// the start of the session, else the error wraps ErrInvalidInput.
+func (s *SQLStore) CloseSessionAt(sessionID int, at time.Time, actor string) error {
+	at, err := eventTime(at)
+	if err != nil {
+		return err
+	}
+	err = s.withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("select id from plages where stop is null" + s.dialect.forUpdate); err != nil {
+			return err
+		}
+		var userID int
+		var start time.Time
+		var stop sql.NullTime
+		if err := tx.QueryRow("select userID, start, stop from sessions where id = $1", sessionID).Scan(&userID, &start, &stop); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return notFound("no session with id %d", sessionID)
+			}
+			return err
+		}
+		if stop.Valid {
+			return nil
+		}
+		if at.Before(start) {
+			return invalidInput("session %d started at %s, it can't close before", sessionID, start.UTC().Format(time.RFC3339))
+		}
+		return s.closeSessionsAt(tx, userID, []int{sessionID}, at, actor)
+	})
+	return unavailable("close session", err)
+}
 
-	var temp int
-	var exists bool
-	err := db.QueryRow("select count(*) from link where userID = $1 and endPlageID is null", id).Scan(&temp)
+// Disconnect the user inside tx, see UserDeconnection.
+func (s *SQLStore) userDeconnection(tx *sql.Tx, id int, actor string) error {
+	if _, err := tx.Exec("select id from plages where stop is null" + s.dialect.forUpdate); err != nil {
+		return err
+	}
+	rows, err := tx.Query("select id from sessions where userID = $1 and stop is null order by id", id)
 	if err != nil {
-		fmt.Printf("The user doesn't exist, or there was an error in UserDeconnection : %s", err)
+		return err
 	}
-	exists = temp > 0
-	if exists {
-		//We get the new current number of users logged in
-		var nbrUsers int
-		if err = db.QueryRow("SELECT COUNT(*) FROM link WHERE link.endPlageID is null").Scan(&nbrUsers); err != nil {
-			log.Fatal(err)
-		}
-		nbrUsers--
-
-		//We start a new time range
-		var plageID int
-		var t time.Time
-		//fmt.Printf("User %d disconnected at %s", id, time.Now().UTC().String())
-		if err = db.QueryRow("insert into plages (start, stop, nbr_users) values ($1, null, $2) returning id, start",
-			time.Now().UTC(), nbrUsers).Scan(&plageID, &t); err != nil {
-			log.Fatal(err)
-		}
-		//We end the previous time range
-		if _, err = db.Exec("update plages set stop = $1 where id = $2 - 1", t, plageID); err != nil {
-			log.Fatal(err)
-		}
-		//We end the link of the user
-		if _, err = db.Exec("update link set endPlageID = $1 where userID = $2 and endPlageID is null", plageID-1, id); err != nil {
-			log.Fatal(err)
-		}
-		// This is to add some data to the users, not really useful
-		if _, err = db.Exec("update users set end_session = $1 where id = $2", t, id); err != nil {
-			log.Fatal(err)
+	sessionIDs := []int{}
+	for rows.Next() {
+		var sessionID int
+		if err := rows.Scan(&sessionID); err != nil {
+			rows.Close()
+			return err
 		}
+		sessionIDs = append(sessionIDs, sessionID)
 	}
+	rows.Close()
+	if len(sessionIDs) == 0 {
+		return nil
+	}
+	return s.closeSessionsAt(tx, id, sessionIDs, time.Now().UTC(), actor)
+}
+
+// Close the open sessions of the user inside tx as if they had ended at the time at (or when they started, if it is later),
+// and derive the time-ranges again from then : the sessions leave the time-ranges after at, and so does the user
+// where it had no other session.
+func (s *SQLStore) closeSessionsAt(tx *sql.Tx, userID int, sessionIDs []int, at time.Time, actor string) error {
+	if _, err := tx.Exec("select id from plages where stop is null" + s.dialect.forUpdate); err != nil {
+		return err
+	}
+	//The end of the previous session of the user, changed by the disconnection
+	var endSession sql.NullTime
+	if err := tx.QueryRow("select end_session from users where id = $1", userID).Scan(&endSession); err != nil {
+		return err
+	}
+	var open int
+	if err := tx.QueryRow("select count(*) from sessions where userID = $1 and stop is null", userID).Scan(&open); err != nil {
+		return err
+	}
+	lastSession := open <= len(sessionIDs) //The user has no session left afterwards
+	previous := map[string]interface{}{"end_session": endSession, "openSessions": open}
+
+	from, lastStop := at, at
+	for _, sessionID := range sessionIDs {
+		var start time.Time
+		if err := tx.QueryRow("select start from sessions where id = $1", sessionID).Scan(&start); err != nil {
+			return err
+		}
+		stop := at
+		if stop.Before(start) {
+			stop = start.UTC()
+		}
+		if err := closeSession(tx, sessionID, stop, actor); err != nil {
+			return err
+		}
+		if stop.Before(from) {
+			from = stop
+		}
+		if stop.After(lastStop) {
+			lastStop = stop
+		}
+	}
+	if err := s.derivePlages(tx, from); err != nil {
+		return err
+	}
+	// This is to add some data to the users, not really useful
+	if lastSession {
+		if _, err := tx.Exec("update users set end_session = $1 where id = $2", lastStop, userID); err != nil {
+			return err
+		}
+	}
+	return writeAudit(tx, actor, AuditDeconnection, userID, previous,
+		map[string]interface{}{"sessions": sessionIDs, "stop": lastStop})
 }
 
-// Insert fake data into the postgres database. It connects a random number of users, then disconnect some of them, and reconnect some.
+// Insert fake data into the session store. It connects a random number of users, then disconnect some of them, and reconnect some.
 // This means it also happen to connect/disconnect someone who is already connected/is not connecte, checking for errors and edge cases.
-func PopulatePostgres(db *sql.DB) {
+func PopulateSessionStore(store SessionStore) {
 	fmt.Println("------------------ Starting to populate the database... please wait (can be quite long) ------------- ")
 
 	r := 3000 - rand.Intn(1500)
@@ -244,7 +370,9 @@ func PopulatePostgres(db *sql.DB) {
 		if i == r/2 {
 			fmt.Println("We are halfway ! Be strong !")
 		}
-		UserConnection(db, i)
+		if err := store.UserConnection(i, SessionInfo{ClientType: "fake"}, "populate"); err != nil {
+			fmt.Println(err)
+		}
 		time.Sleep(10 * time.Millisecond)
 	}
 
@@ -256,7 +384,9 @@ func PopulatePostgres(db *sql.DB) {
 			fmt.Println("Half of the work is done : [##########          ]")
 		}
 		userDecoID := rand.Intn(r - 1)
-		UserDeconnection(db, userDecoID)
+		if err := store.UserDeconnection(userDecoID, "populate"); err != nil {
+			fmt.Println(err)
+		}
 		time.Sleep(10 * time.Millisecond)
 
 	}
@@ -270,7 +400,9 @@ func PopulatePostgres(db *sql.DB) {
 			print("Almost finished !")
 		}
 		userRecoID := rand.Intn(r - 1)
-		UserConnection(db, userRecoID)
+		if err := store.UserConnection(userRecoID, SessionInfo{ClientType: "fake"}, "populate"); err != nil {
+			fmt.Println(err)
+		}
 		time.Sleep(10 * time.Millisecond)
 
 	}
@@ -2,20 +2,60 @@ package routes
 
 import (
 	"data_api/server/controller"
-	"database/sql"
+	"data_api/server/model"
 
 	"github.com/gin-gonic/gin"
 )
 
 // Create all the endpoints for the gin router, and associate them with the correct functions from the controller package.
-func CreateRoutes(router *gin.Engine, db *sql.DB, bucket, org, token, url string) {
-	router.GET("/users", controller.GetUsers(db))
-	router.GET("/users/:id", controller.GetUserById(db))
-	router.GET("/users/:id/links", controller.GetUserTimesById(db))
-	router.GET("/plages", controller.GetTimeRanges(db))
-	router.GET("/plages/:id", controller.GetTimerangeById(db))
-	router.GET("/users/:id/consumption", controller.GetAllDailyMean(db, bucket, org, token, url))
-	router.GET("/users/:id/today", controller.GetTodayHighlights(db, bucket, org, token, url))
-	router.GET("/users/:id/weeklyMean", controller.GetWeeklyMean(db, bucket, org, token, url))
-	router.GET("/users/:id/rank", controller.GetRank(db, bucket, org, token, url))
+func CreateRoutes(router *gin.Engine, store model.SessionStore, energy model.EnergyStore) {
+	router.GET("/users", controller.GetUsers(store))
+	router.GET("/users/:id", controller.GetUserById(store))
+	router.GET("/users/lookup", controller.GetUserByExternalID(store))
+	router.GET("/users/:id/links", controller.GetUserTimesById(store))
+	router.GET("/plages", controller.GetTimeRanges(store))
+	router.GET("/plages/:id", controller.GetTimerangeById(store))
+	router.GET("/downtimes", controller.GetDowntimes(store))
+	router.GET("/events", controller.GetSessionEvents(store))
+	router.GET("/users/:id/consumption", controller.GetAllDailyMean(store, energy))
+	router.GET("/users/:id/today", controller.GetTodayHighlights(store, energy))
+	router.GET("/users/:id/weeklyMean", controller.GetWeeklyMean(store, energy))
+	router.GET("/users/:id/rank", controller.GetRank(store, energy))
+	router.GET("/users/:id/energy", controller.GetEnergySeries(store, energy))
+	router.GET("/users/:id/sessions", controller.GetUserSessions(store))
+	router.GET("/groups", controller.GetGroups(store))
+	router.GET("/groups/:id", controller.GetGroupById(store))
+	router.GET("/groups/:id/members", controller.GetGroupMembers(store))
+	router.GET("/groups/:id/consumption", controller.GetGroupAllDailyMean(store, energy))
+	router.GET("/groups/:id/today", controller.GetGroupTodayHighlights(store, energy))
+	router.GET("/groups/:id/weeklyMean", controller.GetGroupWeeklyMean(store, energy))
+	router.GET("/groups/:id/rank", controller.GetGroupRank(store, energy))
+
+	//Only the prometheus backend can be scraped
+	if metrics, ok := energy.(model.MetricsWriter); ok {
+		router.GET("/metrics", controller.GetMetrics(metrics))
+	}
+
+	//The same consumption endpoints with named fields, units and periods. The ones above stay for the older clients
+	v2 := router.Group("/api/v2")
+	for path, kind := range map[string]string{"/users/:id": controller.SubjectUser, "/groups/:id": controller.SubjectGroup} {
+		v2.GET(path+"/today", controller.GetTodayV2(store, energy, kind))
+		v2.GET(path+"/consumption", controller.GetDailyMeansV2(store, energy, kind))
+		v2.GET(path+"/weeklyMean", controller.GetWeeklyMeansV2(store, energy, kind))
+		v2.GET(path+"/rank", controller.GetRankV2(store, energy, kind))
+		v2.GET(path+"/energy", controller.GetEnergySeriesV2(store, energy, kind))
+	}
+
+	write := router.Group("", controller.APIAuth())
+	write.POST("/sessions", controller.OpenSessionHandler(store))
+	write.DELETE("/sessions/:id", controller.CloseSessionHandler(store))
+	write.POST("/users", controller.CreateUserHandler(store))
+	write.PUT("/users/:id/timezone", controller.SetUserTimezoneHandler(store))
+	write.POST("/users/:id/heartbeat", controller.UserHeartbeat(store))
+	write.POST("/sessions/:id/heartbeat", controller.SessionHeartbeat(store))
+
+	admin := router.Group("/admin", controller.AdminAuth())
+	admin.POST("/users/:id/erase", controller.EraseUserHandler(store))
+	admin.GET("/audit", controller.GetAuditLog(store))
+	admin.POST("/plages/rebuild", controller.RebuildTimeRanges(store))
 }